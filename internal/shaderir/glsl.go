@@ -0,0 +1,587 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// structSet assigns a stable "S<n>" name to each distinct struct Type
+// appearing in a Program's Uniforms, in the order they are first
+// encountered. Nested struct fields are registered before the struct that
+// contains them.
+type structSet struct {
+	order []Type
+}
+
+func (s *structSet) register(ts []Type) {
+	for _, t := range ts {
+		if t.Main != Struct {
+			continue
+		}
+		s.register(t.Sub)
+		if s.indexOf(t) == -1 {
+			s.order = append(s.order, t)
+		}
+	}
+}
+
+func (s *structSet) indexOf(t Type) int {
+	for i, o := range s.order {
+		if reflect.DeepEqual(o, t) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Program) collectStructs() *structSet {
+	s := &structSet{}
+	s.register(p.Uniforms)
+	return s
+}
+
+func (s *structSet) name(t Type) string {
+	return fmt.Sprintf("S%d", s.indexOf(t))
+}
+
+func glslVarType(t Type, s *structSet) string {
+	switch t.Main {
+	case None:
+		return "void"
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Vec2:
+		return "vec2"
+	case Vec3:
+		return "vec3"
+	case Vec4:
+		return "vec4"
+	case Mat2:
+		return "mat2"
+	case Mat3:
+		return "mat3"
+	case Mat4:
+		return "mat4"
+	case Array:
+		return fmt.Sprintf("%s[%d]", glslVarType(t.Sub[0], s), t.Length)
+	case Struct:
+		return s.name(t)
+	default:
+		panic(fmt.Sprintf("shaderir: unexpected type: %d", t.Main))
+	}
+}
+
+func glslStructDecl(t Type, s *structSet) string {
+	lines := []string{fmt.Sprintf("struct %s {", s.name(t))}
+	for i, f := range t.Sub {
+		lines = append(lines, fmt.Sprintf("\t%s M%d;", glslVarType(f, s), i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+// glslStorageBufferDecl declares idx's storage buffer as its own anonymous
+// SSBO interface block, so its single member (named B<idx>, matching a
+// StorageVariable expression's rendering) is promoted straight into global
+// scope instead of needing a block-instance qualifier.
+func glslStorageBufferDecl(t Type, idx int, s *structSet) string {
+	lines := []string{fmt.Sprintf("layout(std430, binding=%d) buffer Buffer%d {", idx, idx)}
+	lines = append(lines, fmt.Sprintf("\t%s B%d;", glslVarType(t, s), idx))
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+var glslOps = map[Op]string{
+	Add:                "+",
+	Sub:                "-",
+	Mul:                "*",
+	Div:                "/",
+	ModOp:              "%",
+	LeftShift:          "<<",
+	RightShift:         ">>",
+	LessThanOp:         "<",
+	LessThanEqualOp:    "<=",
+	GreaterThanOp:      ">",
+	GreaterThanEqualOp: ">=",
+	EqualOp:            "==",
+	NotEqualOp:         "!=",
+	And:                "&",
+	Xor:                "^",
+	Or:                 "|",
+	AndAnd:             "&&",
+	OrOr:               "||",
+}
+
+var glslBuiltinFuncs = map[BuiltinFunc]string{
+	BoolF:       "bool",
+	IntF:        "int",
+	FloatF:      "float",
+	Vec2F:       "vec2",
+	Vec3F:       "vec3",
+	Vec4F:       "vec4",
+	Mat2F:       "mat2",
+	Mat3F:       "mat3",
+	Mat4F:       "mat4",
+	Min:         "min",
+	Max:         "max",
+	Mix:         "mix",
+	Clamp:       "clamp",
+	Abs:         "abs",
+	Pow:         "pow",
+	Exp:         "exp",
+	Log:         "log",
+	Sqrt:        "sqrt",
+	InverseSqrt: "inversesqrt",
+	Floor:       "floor",
+	Ceil:        "ceil",
+	Fract:       "fract",
+	Mod:         "mod",
+	Sin:         "sin",
+	Cos:         "cos",
+	Tan:         "tan",
+	Atan:        "atan",
+	Atan2:       "atan",
+	Dot:         "dot",
+	Cross:       "cross",
+	Length:      "length",
+	Distance:    "distance",
+	Normalize:   "normalize",
+	Step:        "step",
+	Smoothstep:  "smoothstep",
+	Texture2DF:  "texture2D",
+
+	GlobalInvocationID:   "gl_GlobalInvocationID",
+	LocalInvocationID:    "gl_LocalInvocationID",
+	LocalInvocationIndex: "gl_LocalInvocationIndex",
+	WorkGroupID:          "gl_WorkGroupID",
+	NumWorkGroupsF:       "gl_NumWorkGroups",
+	Barrier:              "barrier",
+}
+
+var glslAtomicOps = map[Op]string{
+	AtomicAdd:      "atomicAdd",
+	AtomicAnd:      "atomicAnd",
+	AtomicOr:       "atomicOr",
+	AtomicXor:      "atomicXor",
+	AtomicMin:      "atomicMin",
+	AtomicMax:      "atomicMax",
+	AtomicExchange: "atomicExchange",
+	AtomicCompSwap: "atomicCompSwap",
+}
+
+// glslStage identifies which entry point an expression/statement is being
+// rendered for. Local variable numbering depends on it: vertex and
+// fragment functions reserve the low indices for attributes/varyings and
+// the built-in gl_Position/gl_FragCoord values.
+type glslStage int
+
+const (
+	glslStageNone glslStage = iota
+	glslStageVertex
+	glslStageFragment
+	glslStageCompute
+)
+
+type glslContext struct {
+	prog    *Program
+	structs *structSet
+	stage   glslStage
+}
+
+// reserved returns how many local-variable indices are reserved for
+// attributes/varyings, the stage's special built-in value, and (in the
+// fragment stage) the FragmentFunc.OutParams render targets.
+func (c *glslContext) reserved() int {
+	switch c.stage {
+	case glslStageVertex:
+		return len(c.prog.Attributes) + len(c.prog.Varyings) + 1
+	case glslStageFragment:
+		return len(c.prog.Varyings) + 1 + len(c.prog.FragmentFunc.OutParams)
+	default:
+		return 0
+	}
+}
+
+func (c *glslContext) localVarName(idx int) string {
+	switch c.stage {
+	case glslStageVertex:
+		nA := len(c.prog.Attributes)
+		nV := len(c.prog.Varyings)
+		switch {
+		case idx < nA:
+			return fmt.Sprintf("A%d", idx)
+		case idx < nA+nV:
+			return fmt.Sprintf("V%d", idx-nA)
+		case idx == nA+nV:
+			return "gl_Position"
+		default:
+			return fmt.Sprintf("l%d", idx-c.reserved())
+		}
+	case glslStageFragment:
+		nV := len(c.prog.Varyings)
+		nO := len(c.prog.FragmentFunc.OutParams)
+		switch {
+		case idx < nV:
+			return fmt.Sprintf("V%d", idx)
+		case idx == nV:
+			return "gl_FragCoord"
+		case idx < nV+1+nO:
+			k := idx - (nV + 1)
+			if c.prog.GlslVersion == GLSL100ES {
+				return fmt.Sprintf("gl_FragData[%d]", k)
+			}
+			return fmt.Sprintf("O%d", k)
+		default:
+			return fmt.Sprintf("l%d", idx-c.reserved())
+		}
+	default:
+		return fmt.Sprintf("l%d", idx)
+	}
+}
+
+func (c *glslContext) expr(e Expr) string {
+	switch e.Type {
+	case FloatExpr:
+		return fmt.Sprintf("%.9e", e.Float)
+	case UniformVariable:
+		return fmt.Sprintf("U%d", e.Index)
+	case LocalVariable:
+		return c.localVarName(e.Index)
+	case BuiltinFuncExpr:
+		if e.BuiltinFunc == Texture2DF && c.prog.GlslVersion != GLSL100ES {
+			return "texture"
+		}
+		return glslBuiltinFuncs[e.BuiltinFunc]
+	case SwizzlingExpr:
+		return e.Swizzling
+	case FunctionExpr:
+		return fmt.Sprintf("F%d", e.Index)
+	case Binary:
+		return fmt.Sprintf("(%s) %s (%s)", c.expr(e.Exprs[0]), glslOps[e.Op], c.expr(e.Exprs[1]))
+	case Selection:
+		return fmt.Sprintf("(%s) ? (%s) : (%s)", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]), c.expr(e.Exprs[2]))
+	case Call:
+		args := make([]string, len(e.Exprs)-1)
+		for i, a := range e.Exprs[1:] {
+			args[i] = c.expr(a)
+		}
+		return fmt.Sprintf("(%s)(%s)", c.expr(e.Exprs[0]), strings.Join(args, ", "))
+	case FieldSelector:
+		return fmt.Sprintf("(%s).%s", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]))
+	case StorageVariable:
+		return fmt.Sprintf("B%d", e.Index)
+	case Index:
+		return fmt.Sprintf("(%s)[%s]", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]))
+	case Atomic:
+		args := make([]string, len(e.Exprs)-1)
+		for i, a := range e.Exprs[1:] {
+			args[i] = c.expr(a)
+		}
+		return fmt.Sprintf("%s(%s, %s)", glslAtomicOps[e.Op], c.expr(e.Exprs[0]), strings.Join(args, ", "))
+	default:
+		panic(fmt.Sprintf("shaderir: unexpected expr type: %d", e.Type))
+	}
+}
+
+func glslForDelta(delta int) string {
+	switch delta {
+	case 1:
+		return "++"
+	case -1:
+		return "--"
+	default:
+		if delta < 0 {
+			return fmt.Sprintf(" -= %d", -delta)
+		}
+		return fmt.Sprintf(" += %d", delta)
+	}
+}
+
+// sharedVarDecls collects every SharedVars declaration in b (and its nested
+// blocks) as global-scope GLSL text, in the same traversal order block uses
+// to number local variables. GLSL requires "shared" variables at file
+// scope, not inside the function body that uses them, so these are
+// rendered separately and hoisted above the compute entry point.
+func (c *glslContext) sharedVarDecls(b Block, idx int) ([]string, int) {
+	var lines []string
+
+	for _, t := range b.SharedVars {
+		lines = append(lines, fmt.Sprintf("shared %s %s;", glslVarType(t, c.structs), c.localVarName(idx)))
+		idx++
+	}
+	idx += len(b.LocalVars)
+
+	for _, stmt := range b.Stmts {
+		if stmt.Type == For {
+			idx++
+		}
+		for _, blk := range stmt.Blocks {
+			var inner []string
+			inner, idx = c.sharedVarDecls(blk, idx)
+			lines = append(lines, inner...)
+		}
+	}
+
+	return lines, idx
+}
+
+// block renders a block's local variable declarations and statements,
+// returning the rendered text and the next free local-variable index.
+// SharedVars are numbered here but not declared here; see sharedVarDecls.
+func (c *glslContext) block(b Block, idx, level int) (string, int) {
+	ind := strings.Repeat("\t", level)
+	var lines []string
+
+	idx += len(b.SharedVars)
+
+	for _, t := range b.LocalVars {
+		lines = append(lines, fmt.Sprintf("%s%s %s;", ind, glslVarType(t, c.structs), c.localVarName(idx)))
+		idx++
+	}
+
+	for _, stmt := range b.Stmts {
+		switch stmt.Type {
+		case BlockStmt:
+			inner, next := c.block(stmt.Blocks[0], idx, level+1)
+			lines = append(lines, ind+"{")
+			if inner != "" {
+				lines = append(lines, inner)
+			}
+			lines = append(lines, ind+"}")
+			idx = next
+		case If:
+			then, next := c.block(stmt.Blocks[0], idx, level+1)
+			idx = next
+			lines = append(lines, fmt.Sprintf("%sif (%s) {", ind, c.expr(stmt.Exprs[0])))
+			if then != "" {
+				lines = append(lines, then)
+			}
+			if len(stmt.Blocks) > 1 && (len(stmt.Blocks[1].Stmts) > 0 || len(stmt.Blocks[1].LocalVars) > 0) {
+				els, next := c.block(stmt.Blocks[1], idx, level+1)
+				idx = next
+				lines = append(lines, ind+"} else {")
+				if els != "" {
+					lines = append(lines, els)
+				}
+			}
+			lines = append(lines, ind+"}")
+		case For:
+			loopIdx := idx
+			idx++
+			body, next := c.block(stmt.Blocks[0], idx, level+1)
+			idx = next
+			name := c.localVarName(loopIdx)
+			lines = append(lines, fmt.Sprintf("%sfor (int %s = %d; %s %s %d; %s%s) {",
+				ind, name, stmt.ForInit, name, glslOps[stmt.ForOp], stmt.ForEnd, name, glslForDelta(stmt.ForDelta)))
+			if body != "" {
+				lines = append(lines, body)
+			}
+			lines = append(lines, ind+"}")
+		case Assign:
+			lines = append(lines, fmt.Sprintf("%s%s = %s;", ind, c.expr(stmt.Exprs[0]), c.expr(stmt.Exprs[1])))
+		case ExprStmt:
+			lines = append(lines, ind+c.expr(stmt.Exprs[0])+";")
+		case Return:
+			if len(stmt.Exprs) > 0 {
+				lines = append(lines, ind+"return "+c.expr(stmt.Exprs[0])+";")
+			} else {
+				lines = append(lines, ind+"return;")
+			}
+		case Continue:
+			lines = append(lines, ind+"continue;")
+		case Break:
+			lines = append(lines, ind+"break;")
+		}
+	}
+
+	return strings.Join(lines, "\n"), idx
+}
+
+func (c *glslContext) paramsWithStructs(f Func) string {
+	var params []string
+	idx := 0
+	add := func(qualifier string, t Type) {
+		params = append(params, fmt.Sprintf("%s %s l%d", qualifier, glslVarType(t, c.structs), idx))
+		idx++
+	}
+	for _, t := range f.InParams {
+		add("in", t)
+	}
+	for _, t := range f.InOutParams {
+		add("inout", t)
+	}
+	for _, t := range f.OutParams {
+		add("out", t)
+	}
+	if len(params) == 0 {
+		return "void"
+	}
+	return strings.Join(params, ", ")
+}
+
+func (c *glslContext) funcDecl(f Func) string {
+	retType := "void"
+	if f.Return.Main != None {
+		retType = glslVarType(f.Return, c.structs)
+	}
+	header := fmt.Sprintf("%s F%d(%s) {", retType, f.Index, c.paramsWithStructs(f))
+
+	startIdx := len(f.InParams) + len(f.InOutParams) + len(f.OutParams)
+	body, _ := c.block(f.Block, startIdx, 1)
+
+	lines := []string{header}
+	if body != "" {
+		lines = append(lines, body)
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+func glslDefined(b Block) bool {
+	return len(b.Stmts) > 0 || len(b.LocalVars) > 0 || len(b.SharedVars) > 0
+}
+
+// Glsl compiles the program to GLSL source code in the dialect
+// p.GlslVersion selects. The output is a single source usable for the
+// vertex, fragment and compute stages, gated by the
+// COMPILING_VERTEX_SHADER / COMPILING_FRAGMENT_SHADER /
+// COMPILING_COMPUTE_SHADER preprocessor macros, as is customary for
+// Ebiten's shader plumbing.
+func (p *Program) Glsl() string {
+	s := p.collectStructs()
+	var lines []string
+
+	switch p.GlslVersion {
+	case GLSL300ES:
+		lines = append(lines, "#version 300 es", "precision mediump float;")
+	case GLSL330:
+		lines = append(lines, "#version 330")
+	case GLSL430:
+		lines = append(lines, "#version 430")
+	}
+
+	for _, t := range s.order {
+		lines = append(lines, glslStructDecl(t, s))
+	}
+	for i, t := range p.Uniforms {
+		lines = append(lines, fmt.Sprintf("uniform %s U%d;", glslVarType(t, s), i))
+	}
+
+	if p.GlslVersion == GLSL100ES {
+		for i, t := range p.Attributes {
+			lines = append(lines, fmt.Sprintf("attribute %s A%d;", glslVarType(t, s), i))
+		}
+		for i, t := range p.Varyings {
+			lines = append(lines, fmt.Sprintf("varying %s V%d;", glslVarType(t, s), i))
+		}
+	} else {
+		if glslDefined(p.VertexFunc.Block) {
+			var vLines []string
+			for i, t := range p.Attributes {
+				vLines = append(vLines, fmt.Sprintf("in %s A%d;", glslVarType(t, s), i))
+			}
+			for i, t := range p.Varyings {
+				vLines = append(vLines, fmt.Sprintf("out %s V%d;", glslVarType(t, s), i))
+			}
+			if len(vLines) > 0 {
+				lines = append(lines, "#if defined(COMPILING_VERTEX_SHADER)\n"+strings.Join(vLines, "\n")+"\n#endif")
+			}
+		}
+		if glslDefined(p.FragmentFunc.Block) {
+			var fLines []string
+			for i, t := range p.Varyings {
+				fLines = append(fLines, fmt.Sprintf("in %s V%d;", glslVarType(t, s), i))
+			}
+			for i, t := range p.FragmentFunc.OutParams {
+				fLines = append(fLines, fmt.Sprintf("layout(location=%d) out %s O%d;", i, glslVarType(t, s), i))
+			}
+			if len(fLines) > 0 {
+				lines = append(lines, "#if defined(COMPILING_FRAGMENT_SHADER)\n"+strings.Join(fLines, "\n")+"\n#endif")
+			}
+		}
+	}
+
+	fctx := &glslContext{prog: p, structs: s, stage: glslStageNone}
+	for _, f := range p.Funcs {
+		lines = append(lines, fctx.funcDecl(f))
+	}
+
+	if glslDefined(p.VertexFunc.Block) {
+		c := &glslContext{prog: p, structs: s, stage: glslStageVertex}
+		body, _ := c.block(p.VertexFunc.Block, c.reserved(), 1)
+		vLines := []string{"#if defined(COMPILING_VERTEX_SHADER)", "void main(void) {"}
+		if body != "" {
+			vLines = append(vLines, body)
+		}
+		vLines = append(vLines, "}", "#endif")
+		lines = append(lines, strings.Join(vLines, "\n"))
+	}
+
+	if glslDefined(p.FragmentFunc.Block) {
+		c := &glslContext{prog: p, structs: s, stage: glslStageFragment}
+		body, _ := c.block(p.FragmentFunc.Block, c.reserved(), 1)
+		fLines := []string{"#if defined(COMPILING_FRAGMENT_SHADER)", "void main(void) {"}
+		if body != "" {
+			fLines = append(fLines, body)
+		}
+		fLines = append(fLines, "}", "#endif")
+		lines = append(lines, strings.Join(fLines, "\n"))
+	}
+
+	if glslDefined(p.ComputeFunc.Block) {
+		c := &glslContext{prog: p, structs: s, stage: glslStageCompute}
+		sharedLines, _ := c.sharedVarDecls(p.ComputeFunc.Block, c.reserved())
+		body, _ := c.block(p.ComputeFunc.Block, c.reserved(), 1)
+		ls := p.ComputeFunc.LocalSize
+
+		cLines := []string{"#if defined(COMPILING_COMPUTE_SHADER)"}
+		if p.GlslVersion == GLSL100ES {
+			// Compute shaders need GLSL 4.30 or later (local_size_*,
+			// storage buffers, atomics); the vertex/fragment sections
+			// above stay ES 1.00-flavored and are compiled separately.
+			// #version must be the very first token a compilation of this
+			// source sees, so it's skipped here when the top-level
+			// GlslVersion already put one there.
+			cLines = append(cLines, "#version 430")
+		}
+		// StorageBuffers and SharedVars are only ever read by a
+		// ComputeFunc, so (like #version) they're declared here, inside
+		// the guard, rather than unconditionally above: anything
+		// unconditional would precede #version in every other
+		// compilation of this same source.
+		for i, t := range p.StorageBuffers {
+			cLines = append(cLines, glslStorageBufferDecl(t, i, s))
+		}
+		cLines = append(cLines, sharedLines...)
+		cLines = append(cLines,
+			fmt.Sprintf("layout(local_size_x=%d, local_size_y=%d, local_size_z=%d) in;", ls[0], ls[1], ls[2]),
+			"void main(void) {",
+		)
+		if body != "" {
+			cLines = append(cLines, body)
+		}
+		cLines = append(cLines, "}", "#endif")
+		lines = append(lines, strings.Join(cLines, "\n"))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,476 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir
+
+import (
+	"fmt"
+	"strings"
+)
+
+func hlslType(t Type, s *structSet) string {
+	switch t.Main {
+	case None:
+		return "void"
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Vec2:
+		return "float2"
+	case Vec3:
+		return "float3"
+	case Vec4:
+		return "float4"
+	case Mat2:
+		return "float2x2"
+	case Mat3:
+		return "float3x3"
+	case Mat4:
+		return "float4x4"
+	case Array:
+		return fmt.Sprintf("%s[%d]", hlslType(t.Sub[0], s), t.Length)
+	case Struct:
+		return s.name(t)
+	default:
+		panic(fmt.Sprintf("shaderir: unexpected type: %d", t.Main))
+	}
+}
+
+var hlslBuiltinFuncs = map[BuiltinFunc]string{
+	BoolF:       "bool",
+	IntF:        "int",
+	FloatF:      "float",
+	Vec2F:       "float2",
+	Vec3F:       "float3",
+	Vec4F:       "float4",
+	Mat2F:       "float2x2",
+	Mat3F:       "float3x3",
+	Mat4F:       "float4x4",
+	Min:         "min",
+	Max:         "max",
+	Mix:         "lerp",
+	Clamp:       "clamp",
+	Abs:         "abs",
+	Pow:         "pow",
+	Exp:         "exp",
+	Log:         "log",
+	Sqrt:        "sqrt",
+	InverseSqrt: "rsqrt",
+	Floor:       "floor",
+	Ceil:        "ceil",
+	Fract:       "frac",
+	Mod:         "fmod",
+	Sin:         "sin",
+	Cos:         "cos",
+	Tan:         "tan",
+	Atan:        "atan",
+	Atan2:       "atan2",
+	Dot:         "dot",
+	Cross:       "cross",
+	Length:      "length",
+	Distance:    "distance",
+	Normalize:   "normalize",
+	Step:        "step",
+	Smoothstep:  "smoothstep",
+	Texture2DF:  "Tex.Sample",
+}
+
+type hlslContext struct {
+	prog    *Program
+	structs *structSet
+	stage   glslStage
+}
+
+func (c *hlslContext) reserved() int {
+	switch c.stage {
+	case glslStageVertex:
+		return len(c.prog.Attributes) + len(c.prog.Varyings) + 1
+	case glslStageFragment:
+		return len(c.prog.Varyings) + 1 + len(c.prog.FragmentFunc.OutParams)
+	default:
+		return 0
+	}
+}
+
+// localVarName mirrors glslContext's index scheme. Attributes and varyings
+// live on the VSInput/Varyings structs HLSL's semantics require,
+// gl_Position/gl_FragCoord map to the struct's SV_Position member, and each
+// FragmentFunc.OutParams slot maps to its own FSOutput.TargetN member.
+func (c *hlslContext) localVarName(idx int) string {
+	switch c.stage {
+	case glslStageVertex:
+		nA := len(c.prog.Attributes)
+		nV := len(c.prog.Varyings)
+		switch {
+		case idx < nA:
+			return fmt.Sprintf("input.A%d", idx)
+		case idx < nA+nV:
+			return fmt.Sprintf("output.V%d", idx-nA)
+		case idx == nA+nV:
+			return "output.Position"
+		default:
+			return fmt.Sprintf("l%d", idx-c.reserved())
+		}
+	case glslStageFragment:
+		nV := len(c.prog.Varyings)
+		nO := len(c.prog.FragmentFunc.OutParams)
+		switch {
+		case idx < nV:
+			return fmt.Sprintf("input.V%d", idx)
+		case idx == nV:
+			return "input.Position"
+		case idx < nV+1+nO:
+			return fmt.Sprintf("output.Target%d", idx-(nV+1))
+		default:
+			return fmt.Sprintf("l%d", idx-c.reserved())
+		}
+	default:
+		return fmt.Sprintf("l%d", idx)
+	}
+}
+
+func (c *hlslContext) expr(e Expr) string {
+	switch e.Type {
+	case FloatExpr:
+		return fmt.Sprintf("%.9e", e.Float)
+	case UniformVariable:
+		return fmt.Sprintf("U%d", e.Index)
+	case LocalVariable:
+		return c.localVarName(e.Index)
+	case BuiltinFuncExpr:
+		return hlslBuiltinFuncs[e.BuiltinFunc]
+	case SwizzlingExpr:
+		return e.Swizzling
+	case FunctionExpr:
+		return fmt.Sprintf("F%d", e.Index)
+	case Binary:
+		return fmt.Sprintf("(%s) %s (%s)", c.expr(e.Exprs[0]), glslOps[e.Op], c.expr(e.Exprs[1]))
+	case Selection:
+		return fmt.Sprintf("(%s) ? (%s) : (%s)", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]), c.expr(e.Exprs[2]))
+	case Call:
+		args := make([]string, len(e.Exprs)-1)
+		for i, a := range e.Exprs[1:] {
+			args[i] = c.expr(a)
+		}
+		if callee := e.Exprs[0]; callee.Type == BuiltinFuncExpr {
+			switch callee.BuiltinFunc {
+			case Texture2DF:
+				// Texture2DF isn't a free function in HLSL: it's a method on
+				// a Texture2D object, called with an explicit SamplerState.
+				// Tex and TexSampler are the fixed t0/s0 bindings
+				// hlslTextureDecl declares.
+				return fmt.Sprintf("Tex.Sample(TexSampler, %s)", strings.Join(args, ", "))
+			case BoolF, IntF, FloatF, Vec2F, Vec3F, Vec4F, Mat2F, Mat3F, Mat4F:
+				// hlslBuiltinFuncs maps these to type names (float4, ...),
+				// and HLSL has no (type)(args) constructor syntax: wrapping
+				// the type in parens makes it a C-style cast applied to the
+				// comma-expression (args), which silently drops every
+				// argument but the last. Call the type name directly.
+				return fmt.Sprintf("%s(%s)", hlslBuiltinFuncs[callee.BuiltinFunc], strings.Join(args, ", "))
+			case Mod:
+				// HLSL's fmod is truncated, but the IR's Mod is floored (see
+				// its doc comment): expand rather than call fmod directly.
+				return fmt.Sprintf("(%s) - (%s) * floor((%s) / (%s))", args[0], args[1], args[0], args[1])
+			}
+		}
+		return fmt.Sprintf("(%s)(%s)", c.expr(e.Exprs[0]), strings.Join(args, ", "))
+	case FieldSelector:
+		return fmt.Sprintf("(%s).%s", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]))
+	default:
+		panic(fmt.Sprintf("shaderir: unexpected expr type: %d", e.Type))
+	}
+}
+
+func (c *hlslContext) block(b Block, idx, level int) (string, int) {
+	ind := strings.Repeat("\t", level)
+	var lines []string
+
+	for _, t := range b.LocalVars {
+		lines = append(lines, fmt.Sprintf("%s%s %s;", ind, hlslType(t, c.structs), c.localVarName(idx)))
+		idx++
+	}
+
+	for _, stmt := range b.Stmts {
+		switch stmt.Type {
+		case BlockStmt:
+			inner, next := c.block(stmt.Blocks[0], idx, level+1)
+			lines = append(lines, ind+"{")
+			if inner != "" {
+				lines = append(lines, inner)
+			}
+			lines = append(lines, ind+"}")
+			idx = next
+		case If:
+			then, next := c.block(stmt.Blocks[0], idx, level+1)
+			idx = next
+			lines = append(lines, fmt.Sprintf("%sif (%s) {", ind, c.expr(stmt.Exprs[0])))
+			if then != "" {
+				lines = append(lines, then)
+			}
+			if len(stmt.Blocks) > 1 && (len(stmt.Blocks[1].Stmts) > 0 || len(stmt.Blocks[1].LocalVars) > 0) {
+				els, next := c.block(stmt.Blocks[1], idx, level+1)
+				idx = next
+				lines = append(lines, ind+"} else {")
+				if els != "" {
+					lines = append(lines, els)
+				}
+			}
+			lines = append(lines, ind+"}")
+		case For:
+			loopIdx := idx
+			idx++
+			body, next := c.block(stmt.Blocks[0], idx, level+1)
+			idx = next
+			name := c.localVarName(loopIdx)
+			lines = append(lines, fmt.Sprintf("%sfor (int %s = %d; %s %s %d; %s%s) {",
+				ind, name, stmt.ForInit, name, glslOps[stmt.ForOp], stmt.ForEnd, name, glslForDelta(stmt.ForDelta)))
+			if body != "" {
+				lines = append(lines, body)
+			}
+			lines = append(lines, ind+"}")
+		case Assign:
+			lines = append(lines, fmt.Sprintf("%s%s = %s;", ind, c.expr(stmt.Exprs[0]), c.expr(stmt.Exprs[1])))
+		case ExprStmt:
+			lines = append(lines, ind+c.expr(stmt.Exprs[0])+";")
+		case Return:
+			if len(stmt.Exprs) > 0 {
+				lines = append(lines, ind+"return "+c.expr(stmt.Exprs[0])+";")
+			} else {
+				lines = append(lines, ind+"return;")
+			}
+		case Continue:
+			lines = append(lines, ind+"continue;")
+		case Break:
+			lines = append(lines, ind+"break;")
+		}
+	}
+
+	return strings.Join(lines, "\n"), idx
+}
+
+func (c *hlslContext) params(f Func) string {
+	var params []string
+	idx := 0
+	add := func(qualifier string, t Type) {
+		params = append(params, fmt.Sprintf("%s %s l%d", qualifier, hlslType(t, c.structs), idx))
+		idx++
+	}
+	for _, t := range f.InParams {
+		add("in", t)
+	}
+	for _, t := range f.InOutParams {
+		add("inout", t)
+	}
+	for _, t := range f.OutParams {
+		add("out", t)
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return strings.Join(params, ", ")
+}
+
+func (c *hlslContext) funcDecl(f Func) string {
+	retType := "void"
+	if f.Return.Main != None {
+		retType = hlslType(f.Return, c.structs)
+	}
+	header := fmt.Sprintf("%s F%d(%s) {", retType, f.Index, c.params(f))
+
+	startIdx := len(f.InParams) + len(f.InOutParams) + len(f.OutParams)
+	body, _ := c.block(f.Block, startIdx, 1)
+
+	lines := []string{header}
+	if body != "" {
+		lines = append(lines, body)
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+// hlslAttributeSemantic returns the HLSL input semantic for attribute i.
+// Attribute 0 is conventionally the vertex position; the rest are plain
+// texture-coordinate-shaped payload, so they ride on TEXCOORDn.
+func hlslAttributeSemantic(i int) string {
+	if i == 0 {
+		return "POSITION"
+	}
+	return fmt.Sprintf("TEXCOORD%d", i-1)
+}
+
+func hlslVSInputDecl(p *Program, s *structSet) string {
+	if len(p.Attributes) == 0 {
+		return ""
+	}
+	lines := []string{"struct VSInput {"}
+	for i, t := range p.Attributes {
+		lines = append(lines, fmt.Sprintf("\t%s A%d : %s;", hlslType(t, s), i, hlslAttributeSemantic(i)))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+func hlslVaryingsDecl(p *Program, s *structSet) string {
+	lines := []string{"struct Varyings {", "\tfloat4 Position : SV_Position;"}
+	for i, t := range p.Varyings {
+		lines = append(lines, fmt.Sprintf("\t%s V%d : TEXCOORD%d;", hlslType(t, s), i, i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+// hlslFSOutputDecl declares the fragment stage's output struct, one
+// SV_TargetN-tagged member per FragmentFunc.OutParams entry (multiple
+// entries mean multiple render targets).
+func hlslFSOutputDecl(p *Program, s *structSet) string {
+	lines := []string{"struct FSOutput {"}
+	for i, t := range p.FragmentFunc.OutParams {
+		lines = append(lines, fmt.Sprintf("\t%s Target%d : SV_Target%d;", hlslType(t, s), i, i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+// hlslTextureDecl declares the fixed t0/s0 binding Tex.Sample calls resolve
+// against (see hlslContext.expr's Call case).
+func hlslTextureDecl() string {
+	return "Texture2D Tex : register(t0);\nSamplerState TexSampler : register(s0);"
+}
+
+// exprUsesTexture2DF reports whether e or any of its subexpressions call
+// the Texture2DF builtin.
+func exprUsesTexture2DF(e Expr) bool {
+	if e.Type == BuiltinFuncExpr && e.BuiltinFunc == Texture2DF {
+		return true
+	}
+	for _, sub := range e.Exprs {
+		if exprUsesTexture2DF(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func blockUsesTexture2DF(b Block) bool {
+	for _, stmt := range b.Stmts {
+		for _, e := range stmt.Exprs {
+			if exprUsesTexture2DF(e) {
+				return true
+			}
+		}
+		for _, blk := range stmt.Blocks {
+			if blockUsesTexture2DF(blk) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hlslUsesTexture reports whether p samples a texture anywhere, so Hlsl
+// only declares the Tex/TexSampler binding when something actually needs it.
+func hlslUsesTexture(p *Program) bool {
+	for _, f := range p.Funcs {
+		if blockUsesTexture2DF(f.Block) {
+			return true
+		}
+	}
+	return blockUsesTexture2DF(p.VertexFunc.Block) || blockUsesTexture2DF(p.FragmentFunc.Block)
+}
+
+func hlslCBufferDecl(p *Program, s *structSet) string {
+	if len(p.Uniforms) == 0 {
+		return ""
+	}
+	lines := []string{"cbuffer CB0 : register(b0) {"}
+	for i, t := range p.Uniforms {
+		lines = append(lines, fmt.Sprintf("\t%s U%d;", hlslType(t, s), i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+// Hlsl compiles the program to HLSL Shader Model 5.0, so it can drive a
+// Direct3D 11 backend the way gioui.org's d3d11 driver does. Uniforms are
+// packed into a single constant buffer, attributes and varyings are
+// gathered into semantic-tagged structs, and gl_Position/gl_FragCoord
+// become the Varyings struct's SV_Position member.
+//
+// GLSL's clip-space Y axis points the opposite way from Direct3D's, so the
+// vertex stage negates the Y component of Position at the end of its body,
+// just before returning; by
+// the time the fragment stage reads it back through SV_Position, it
+// already matches the gl_FragCoord convention the IR was built against.
+func (p *Program) Hlsl() string {
+	s := p.collectStructs()
+	var lines []string
+
+	for _, t := range s.order {
+		l := []string{fmt.Sprintf("struct %s {", s.name(t))}
+		for i, f := range t.Sub {
+			l = append(l, fmt.Sprintf("\t%s M%d;", hlslType(f, s), i))
+		}
+		l = append(l, "};")
+		lines = append(lines, strings.Join(l, "\n"))
+	}
+
+	if cb := hlslCBufferDecl(p, s); cb != "" {
+		lines = append(lines, cb)
+	}
+	if hlslUsesTexture(p) {
+		lines = append(lines, hlslTextureDecl())
+	}
+	if in := hlslVSInputDecl(p, s); in != "" {
+		lines = append(lines, in)
+	}
+	if glslDefined(p.VertexFunc.Block) || glslDefined(p.FragmentFunc.Block) || len(p.Varyings) > 0 {
+		lines = append(lines, hlslVaryingsDecl(p, s))
+	}
+
+	fctx := &hlslContext{prog: p, structs: s, stage: glslStageNone}
+	for _, f := range p.Funcs {
+		lines = append(lines, fctx.funcDecl(f))
+	}
+
+	if glslDefined(p.VertexFunc.Block) {
+		c := &hlslContext{prog: p, structs: s, stage: glslStageVertex}
+		body, _ := c.block(p.VertexFunc.Block, c.reserved(), 1)
+
+		vLines := []string{"Varyings Vertex(VSInput input) {", "\tVaryings output;"}
+		if body != "" {
+			vLines = append(vLines, body)
+		}
+		vLines = append(vLines, "\toutput.Position.y = -output.Position.y;", "\treturn output;", "}")
+		lines = append(lines, strings.Join(vLines, "\n"))
+	}
+
+	if glslDefined(p.FragmentFunc.Block) {
+		c := &hlslContext{prog: p, structs: s, stage: glslStageFragment}
+		body, _ := c.block(p.FragmentFunc.Block, c.reserved(), 1)
+
+		lines = append(lines, hlslFSOutputDecl(p, s))
+
+		fLines := []string{"FSOutput Fragment(Varyings input) {", "\tFSOutput output;"}
+		if body != "" {
+			fLines = append(fLines, body)
+		}
+		fLines = append(fLines, "\treturn output;", "}")
+		lines = append(lines, strings.Join(fLines, "\n"))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
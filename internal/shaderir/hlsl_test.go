@@ -0,0 +1,251 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir_test
+
+import (
+	"testing"
+
+	. "github.com/hajimehoshi/ebiten/internal/shaderir"
+)
+
+func TestOutputHlsl(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Program Program
+		Hlsl    string
+	}{
+		{
+			Name:    "Empty",
+			Program: Program{},
+			Hlsl:    ``,
+		},
+		{
+			Name: "CBuffer",
+			Program: Program{
+				Uniforms: []Type{
+					{Main: Float},
+				},
+			},
+			Hlsl: `cbuffer CB0 : register(b0) {
+	float U0;
+};`,
+		},
+		{
+			Name: "Add",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Float},
+							{Main: Float},
+						},
+						OutParams: []Type{
+							{Main: Float},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(2),
+								binaryExpr(
+									Add,
+									localVariableExpr(0),
+									localVariableExpr(1),
+								),
+							),
+						),
+					},
+				},
+			},
+			Hlsl: `void F0(in float l0, in float l1, out float l2) {
+	l2 = (l0) + (l1);
+}`,
+		},
+		{
+			// VertexFunc+FragmentFunc round-trip: note the Y-flip the
+			// vertex stage applies to clip-space Position, and the
+			// SV_Target0-tagged struct the fragment stage builds and
+			// returns with a real computed color.
+			Name: "VertexAndFragmentFunc",
+			Program: Program{
+				Attributes: []Type{
+					{Main: Vec4},
+					{Main: Vec2},
+				},
+				Varyings: []Type{
+					{Main: Vec2},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(2),
+							localVariableExpr(1),
+						),
+					),
+				},
+				FragmentFunc: FragmentFunc{
+					OutParams: []Type{
+						{Main: Vec4},
+					},
+					Block: block(
+						[]Type{
+							{Main: Vec2},
+						},
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(2),
+							callExpr(builtinFuncExpr(Vec4F), localVariableExpr(3), floatExpr(0), floatExpr(1)),
+						),
+					),
+				},
+			},
+			Hlsl: `struct VSInput {
+	float4 A0 : POSITION;
+	float2 A1 : TEXCOORD0;
+};
+struct Varyings {
+	float4 Position : SV_Position;
+	float2 V0 : TEXCOORD0;
+};
+Varyings Vertex(VSInput input) {
+	Varyings output;
+	output.Position = input.A0;
+	output.V0 = input.A1;
+	output.Position.y = -output.Position.y;
+	return output;
+}
+struct FSOutput {
+	float4 Target0 : SV_Target0;
+};
+FSOutput Fragment(Varyings input) {
+	FSOutput output;
+	float2 l0;
+	l0 = input.V0;
+	output.Target0 = float4(l0, 0.000000000e+00, 1.000000000e+00);
+	return output;
+}`,
+		},
+		{
+			// Exercises the builtin translations hlslBuiltinFuncs carries
+			// but that no prior test asserted on: mix/fract/inversesqrt/
+			// atan2, plus a swizzle.
+			Name: "BuiltinFuncsAndSwizzle",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Vec4},
+							{Main: Float},
+						},
+						OutParams: []Type{
+							{Main: Float},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(2),
+								callExpr(
+									builtinFuncExpr(Mix),
+									callExpr(builtinFuncExpr(Fract), fieldSelectorExpr(localVariableExpr(0), swizzlingExpr("x"))),
+									callExpr(builtinFuncExpr(InverseSqrt), localVariableExpr(1)),
+									callExpr(builtinFuncExpr(Atan2), localVariableExpr(1), localVariableExpr(1)),
+								),
+							),
+						),
+					},
+				},
+			},
+			Hlsl: `void F0(in float4 l0, in float l1, out float l2) {
+	l2 = (lerp)((frac)((l0).x), (rsqrt)(l1), (atan2)(l1, l1));
+}`,
+		},
+		{
+			// Texture2DF lowers to a Sample call against the fixed Tex/
+			// TexSampler t0/s0 binding, which is only declared when a
+			// program actually samples a texture.
+			Name: "TextureSample",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Vec2},
+						},
+						OutParams: []Type{
+							{Main: Vec4},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(1),
+								callExpr(builtinFuncExpr(Texture2DF), localVariableExpr(0)),
+							),
+						),
+					},
+				},
+			},
+			Hlsl: `Texture2D Tex : register(t0);
+SamplerState TexSampler : register(s0);
+void F0(in float2 l0, out float4 l1) {
+	l1 = Tex.Sample(TexSampler, l0);
+}`,
+		},
+		{
+			// Mod is floored, unlike HLSL's truncated fmod, so it must
+			// expand to the floored formula rather than call fmod directly.
+			Name: "Mod",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Float},
+							{Main: Float},
+						},
+						OutParams: []Type{
+							{Main: Float},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(2),
+								callExpr(builtinFuncExpr(Mod), localVariableExpr(0), localVariableExpr(1)),
+							),
+						),
+					},
+				},
+			},
+			Hlsl: `void F0(in float l0, in float l1, out float l2) {
+	l2 = (l0) - (l1) * floor((l0) / (l1));
+}`,
+		},
+	}
+	for _, tc := range tests {
+		got := tc.Program.Hlsl()
+		want := tc.Hlsl + "\n"
+		if got != want {
+			t.Errorf("%s: got: %s, want: %s", tc.Name, got, want)
+		}
+	}
+}
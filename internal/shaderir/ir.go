@@ -0,0 +1,310 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shaderir offers an intermediate representation for shader programs
+// and utilities to compile the IR to backend-specific shading languages.
+package shaderir
+
+// Program represents a shader program.
+type Program struct {
+	// GlslVersion selects which GLSL dialect Glsl compiles to. The zero
+	// value, GLSL100ES, reproduces Ebiten's long-standing
+	// attribute/varying, version-pragma-free output.
+	GlslVersion GlslVersion
+
+	Uniforms       []Type
+	Attributes     []Type
+	Varyings       []Type
+	StorageBuffers []Type
+	Funcs          []Func
+	VertexFunc     VertexFunc
+	FragmentFunc   FragmentFunc
+	ComputeFunc    ComputeFunc
+}
+
+// GlslVersion selects the GLSL dialect Program.Glsl compiles to.
+type GlslVersion int
+
+const (
+	// GLSL100ES is GLSL ES 1.00 (OpenGL ES 2.0 / WebGL 1): no #version
+	// pragma, attribute/varying qualifiers, and texture2D().
+	GLSL100ES GlslVersion = iota
+
+	// GLSL300ES is GLSL ES 3.00 (OpenGL ES 3.0 / WebGL 2): #version 300
+	// es, in/out qualifiers, mediump precision, and texture().
+	GLSL300ES
+
+	// GLSL330 is desktop GLSL 3.30 (OpenGL 3.3 Core): #version 330,
+	// in/out qualifiers, and texture().
+	GLSL330
+
+	// GLSL430 is desktop GLSL 4.30 (OpenGL 4.3 Core), the minimum version
+	// a ComputeFunc requires.
+	GLSL430
+)
+
+// BasicType represents a shader's basic types.
+type BasicType int
+
+const (
+	None BasicType = iota
+	Bool
+	Int
+	Float
+	Vec2
+	Vec3
+	Vec4
+	Mat2
+	Mat3
+	Mat4
+	Array
+	Struct
+)
+
+// Type represents a shader's variable type.
+type Type struct {
+	Main BasicType
+
+	// Sub is a type's sub-elements. For an Array, Sub has exactly one
+	// element representing the array's element type. For a Struct, Sub
+	// holds the field types in declaration order.
+	Sub []Type
+
+	// Length is the array length. This is valid only when Main is Array.
+	Length int
+}
+
+// Func represents a function except for the vertex, fragment and compute
+// entry points.
+type Func struct {
+	Index int
+
+	InParams    []Type
+	InOutParams []Type
+	OutParams   []Type
+	Return      Type
+
+	Block Block
+}
+
+// VertexFunc represents a vertex entry point.
+type VertexFunc struct {
+	Block Block
+}
+
+// FragmentFunc represents a fragment entry point.
+type FragmentFunc struct {
+	// OutParams are the fragment shader's color outputs (render targets),
+	// one per entry; more than one entry means multiple render target
+	// (MRT) rendering. Each
+	// becomes its own local-variable slot, numbered right after the
+	// stage's built-in gl_FragCoord value.
+	OutParams []Type
+
+	Block Block
+}
+
+// ComputeFunc represents a compute entry point (a "kernel") dispatched over
+// a grid of workgroups, each made up of LocalSize invocations.
+type ComputeFunc struct {
+	// LocalSize is the compile-time workgroup size declared in the shader
+	// itself (GLSL's layout(local_size_x=.., local_size_y=.., local_size_z=..) in;).
+	LocalSize [3]int
+
+	// NumWorkGroups is the workgroup count a dispatch call issues at
+	// runtime. It has no effect on the compiled shader text — the shader
+	// reads the equivalent value through the NumWorkGroupsF builtin — but
+	// it travels with the Program so that whatever builds
+	// the dispatch call and whatever compiles the shader agree on one
+	// source of truth.
+	NumWorkGroups [3]int
+
+	Block Block
+}
+
+// Block represents a lexical block in a function body.
+type Block struct {
+	// SharedVars are variables declared in workgroup-shared memory (GLSL's
+	// `shared` qualifier), visible to every invocation in the same
+	// workgroup. They share LocalVars' index space and are numbered first.
+	SharedVars []Type
+	LocalVars  []Type
+	Stmts      []Stmt
+}
+
+// StmtType represents a statement's type.
+type StmtType int
+
+const (
+	ExprStmt StmtType = iota
+	BlockStmt
+	Assign
+	If
+	For
+	Return
+	Continue
+	Break
+)
+
+// Stmt represents a statement.
+type Stmt struct {
+	Type StmtType
+
+	Exprs  []Expr
+	Blocks []Block
+
+	ForInit  int
+	ForEnd   int
+	ForOp    Op
+	ForDelta int
+}
+
+// ExprType represents an expression's type.
+type ExprType int
+
+const (
+	FloatExpr ExprType = iota
+	UniformVariable
+	LocalVariable
+	BuiltinFuncExpr
+	SwizzlingExpr
+	FunctionExpr
+	Binary
+	Selection
+	Call
+	FieldSelector
+
+	// StorageVariable refers to Program.StorageBuffers[Index], a
+	// read-write buffer shared across every invocation of a ComputeFunc.
+	StorageVariable
+
+	// Index represents array/buffer element access: Exprs[0] is the
+	// indexed value, Exprs[1] is the index.
+	Index
+
+	// Atomic represents an atomic read-modify-write performed on a
+	// StorageVariable or SharedVars element: Op selects the atomic
+	// operation, Exprs[0] is the target and Exprs[1] is the value. For
+	// AtomicCompSwap, Exprs[1] is the comparator and Exprs[2] is the value
+	// to store, in GLSL's atomicCompSwap argument order.
+	Atomic
+)
+
+// Expr represents an expression.
+type Expr struct {
+	Type ExprType
+
+	Exprs       []Expr
+	Op          Op
+	BuiltinFunc BuiltinFunc
+	Float       float32
+	Index       int
+	Swizzling   string
+}
+
+// Op represents an operator.
+type Op int
+
+const (
+	Add Op = iota
+	Sub
+	Mul
+	Div
+	ModOp
+	LeftShift
+	RightShift
+	LessThanOp
+	LessThanEqualOp
+	GreaterThanOp
+	GreaterThanEqualOp
+	EqualOp
+	NotEqualOp
+	And
+	Xor
+	Or
+	AndAnd
+	OrOr
+	NotOp
+	NegOp
+
+	// The remaining Ops are the atomic read-modify-write operations an
+	// Atomic expression can perform on a storage buffer or shared-memory
+	// element.
+	AtomicAdd
+	AtomicAnd
+	AtomicOr
+	AtomicXor
+	AtomicMin
+	AtomicMax
+	AtomicExchange
+	AtomicCompSwap
+)
+
+// BuiltinFunc represents a built-in function that every backend must know
+// how to spell in its own syntax.
+type BuiltinFunc int
+
+const (
+	BoolF BuiltinFunc = iota
+	IntF
+	FloatF
+	Vec2F
+	Vec3F
+	Vec4F
+	Mat2F
+	Mat3F
+	Mat4F
+	Min
+	Max
+	Mix
+	Clamp
+	Abs
+	Pow
+	Exp
+	Log
+	Sqrt
+	InverseSqrt
+	Floor
+	Ceil
+	Fract
+
+	// Mod is floored modulo (GLSL's mod(x, y) == x - y*floor(x/y)), not the
+	// truncated modulo C-family fmod()/fmod intrinsics compute: the two
+	// disagree on sign for negative operands, so a backend whose native mod
+	// is truncated (HLSL, MSL) must expand Mod rather than call it directly.
+	Mod
+	Sin
+	Cos
+	Tan
+	Atan
+	Atan2
+	Dot
+	Cross
+	Length
+	Distance
+	Normalize
+	Step
+	Smoothstep
+	Texture2DF
+
+	// The remaining built-ins are only meaningful inside a ComputeFunc:
+	// the dispatch-grid identifiers every invocation can read, and the
+	// barrier that synchronizes a workgroup's shared-memory accesses.
+	GlobalInvocationID
+	LocalInvocationID
+	LocalInvocationIndex
+	WorkGroupID
+	NumWorkGroupsF
+	Barrier
+)
@@ -145,6 +145,28 @@ func fieldSelectorExpr(a, b Expr) Expr {
 	}
 }
 
+func storageVariableExpr(index int) Expr {
+	return Expr{
+		Type:  StorageVariable,
+		Index: index,
+	}
+}
+
+func indexExpr(target, index Expr) Expr {
+	return Expr{
+		Type:  Index,
+		Exprs: []Expr{target, index},
+	}
+}
+
+func atomicExpr(op Op, exprs ...Expr) Expr {
+	return Expr{
+		Type:  Atomic,
+		Op:    op,
+		Exprs: exprs,
+	}
+}
+
 func TestOutput(t *testing.T) {
 	tests := []struct {
 		Name    string
@@ -696,6 +718,330 @@ void main(void) {
 }
 #endif`,
 		},
+		{
+			// The simplest compute kernel: square a storage buffer in
+			// place, one invocation per element.
+			Name: "ComputeSquare",
+			Program: Program{
+				StorageBuffers: []Type{
+					{Main: Array, Sub: []Type{{Main: Float}}, Length: 4},
+				},
+				ComputeFunc: ComputeFunc{
+					LocalSize: [3]int{4, 1, 1},
+					Block: block(
+						nil,
+						assignStmt(
+							indexExpr(storageVariableExpr(0), fieldSelectorExpr(builtinFuncExpr(GlobalInvocationID), swizzlingExpr("x"))),
+							binaryExpr(
+								Mul,
+								indexExpr(storageVariableExpr(0), fieldSelectorExpr(builtinFuncExpr(GlobalInvocationID), swizzlingExpr("x"))),
+								indexExpr(storageVariableExpr(0), fieldSelectorExpr(builtinFuncExpr(GlobalInvocationID), swizzlingExpr("x"))),
+							),
+						),
+					),
+				},
+			},
+			Glsl: `#if defined(COMPILING_COMPUTE_SHADER)
+#version 430
+layout(std430, binding=0) buffer Buffer0 {
+	float[4] B0;
+};
+layout(local_size_x=4, local_size_y=1, local_size_z=1) in;
+void main(void) {
+	(B0)[(gl_GlobalInvocationID).x] = ((B0)[(gl_GlobalInvocationID).x]) * ((B0)[(gl_GlobalInvocationID).x]);
+}
+#endif`,
+		},
+		{
+			// A workgroup-local reduction: stage each invocation's value
+			// into shared memory, barrier() to make sure every invocation
+			// has written before any of them reads, then write back out.
+			Name: "ComputeReduction",
+			Program: Program{
+				StorageBuffers: []Type{
+					{Main: Array, Sub: []Type{{Main: Float}}, Length: 4},
+				},
+				ComputeFunc: ComputeFunc{
+					LocalSize: [3]int{4, 1, 1},
+					Block: Block{
+						SharedVars: []Type{
+							{Main: Array, Sub: []Type{{Main: Float}}, Length: 4},
+						},
+						Stmts: []Stmt{
+							assignStmt(
+								indexExpr(localVariableExpr(0), builtinFuncExpr(LocalInvocationIndex)),
+								indexExpr(storageVariableExpr(0), fieldSelectorExpr(builtinFuncExpr(GlobalInvocationID), swizzlingExpr("x"))),
+							),
+							exprStmt(
+								callExpr(builtinFuncExpr(Barrier)),
+							),
+							assignStmt(
+								indexExpr(storageVariableExpr(0), fieldSelectorExpr(builtinFuncExpr(GlobalInvocationID), swizzlingExpr("x"))),
+								indexExpr(localVariableExpr(0), builtinFuncExpr(LocalInvocationIndex)),
+							),
+						},
+					},
+				},
+			},
+			Glsl: `#if defined(COMPILING_COMPUTE_SHADER)
+#version 430
+layout(std430, binding=0) buffer Buffer0 {
+	float[4] B0;
+};
+shared float[4] l0;
+layout(local_size_x=4, local_size_y=1, local_size_z=1) in;
+void main(void) {
+	(l0)[gl_LocalInvocationIndex] = (B0)[(gl_GlobalInvocationID).x];
+	(barrier)();
+	(B0)[(gl_GlobalInvocationID).x] = (l0)[gl_LocalInvocationIndex];
+}
+#endif`,
+		},
+		{
+			// An atomic histogram: bucket each input element with
+			// atomicAdd so concurrent invocations don't race on the same
+			// bin.
+			Name: "ComputeAtomicHistogram",
+			Program: Program{
+				StorageBuffers: []Type{
+					{Main: Array, Sub: []Type{{Main: Float}}, Length: 256},
+					{Main: Array, Sub: []Type{{Main: Int}}, Length: 16},
+				},
+				ComputeFunc: ComputeFunc{
+					LocalSize: [3]int{64, 1, 1},
+					Block: block(
+						nil,
+						exprStmt(
+							atomicExpr(
+								AtomicAdd,
+								indexExpr(
+									storageVariableExpr(1),
+									callExpr(
+										builtinFuncExpr(IntF),
+										indexExpr(storageVariableExpr(0), fieldSelectorExpr(builtinFuncExpr(GlobalInvocationID), swizzlingExpr("x"))),
+									),
+								),
+								callExpr(builtinFuncExpr(IntF), floatExpr(1)),
+							),
+						),
+					),
+				},
+			},
+			Glsl: `#if defined(COMPILING_COMPUTE_SHADER)
+#version 430
+layout(std430, binding=0) buffer Buffer0 {
+	float[256] B0;
+};
+layout(std430, binding=1) buffer Buffer1 {
+	int[16] B1;
+};
+layout(local_size_x=64, local_size_y=1, local_size_z=1) in;
+void main(void) {
+	atomicAdd((B1)[(int)((B0)[(gl_GlobalInvocationID).x])], (int)(1.000000000e+00));
+}
+#endif`,
+		},
+		{
+			// Same vertex+fragment program as the "FragmentFunc" case
+			// above, compiled to GLSL ES 3.00 instead: a version pragma,
+			// precision statement, and stage-gated in/out declarations
+			// in place of the ES 1.00 attribute/varying qualifiers.
+			Name: "Glsl300ESVertexFragment",
+			Program: Program{
+				GlslVersion: GLSL300ES,
+				Uniforms: []Type{
+					{Main: Float},
+				},
+				Attributes: []Type{
+					{Main: Vec4},
+					{Main: Float},
+					{Main: Vec2},
+				},
+				Varyings: []Type{
+					{Main: Float},
+					{Main: Vec2},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(5),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(1),
+						),
+						assignStmt(
+							localVariableExpr(4),
+							localVariableExpr(2),
+						),
+					),
+				},
+				FragmentFunc: FragmentFunc{
+					Block: block(
+						[]Type{
+							{Main: Vec2},
+							{Main: Vec4},
+							{Main: Float},
+						},
+						assignStmt(
+							localVariableExpr(5),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(1),
+						),
+						assignStmt(
+							localVariableExpr(4),
+							localVariableExpr(2),
+						),
+					),
+				},
+			},
+			Glsl: `#version 300 es
+precision mediump float;
+uniform float U0;
+#if defined(COMPILING_VERTEX_SHADER)
+in vec4 A0;
+in float A1;
+in vec2 A2;
+out float V0;
+out vec2 V1;
+#endif
+#if defined(COMPILING_FRAGMENT_SHADER)
+in float V0;
+in vec2 V1;
+#endif
+#if defined(COMPILING_VERTEX_SHADER)
+void main(void) {
+	gl_Position = A0;
+	V0 = A1;
+	V1 = A2;
+}
+#endif
+#if defined(COMPILING_FRAGMENT_SHADER)
+void main(void) {
+	vec2 l0;
+	vec4 l1;
+	float l2;
+	l2 = V0;
+	l0 = V1;
+	l1 = gl_FragCoord;
+}
+#endif`,
+		},
+		{
+			// Two render targets under GLSL 3.30: each FragmentFunc
+			// OutParams entry becomes its own location-qualified "out"
+			// variable.
+			Name: "Glsl330MultipleRenderTargets",
+			Program: Program{
+				GlslVersion: GLSL330,
+				Varyings: []Type{
+					{Main: Vec2},
+				},
+				FragmentFunc: FragmentFunc{
+					OutParams: []Type{
+						{Main: Vec4},
+						{Main: Vec4},
+					},
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(2),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(1),
+						),
+					),
+				},
+			},
+			Glsl: `#version 330
+#if defined(COMPILING_FRAGMENT_SHADER)
+in vec2 V0;
+layout(location=0) out vec4 O0;
+layout(location=1) out vec4 O1;
+#endif
+#if defined(COMPILING_FRAGMENT_SHADER)
+void main(void) {
+	O0 = V0;
+	O1 = gl_FragCoord;
+}
+#endif`,
+		},
+		{
+			// The same two render targets under GLSL ES 1.00, which has
+			// no "out" qualifier: each OutParams slot falls back to an
+			// indexed write into the built-in gl_FragData array instead.
+			Name: "Glsl100ESMultipleRenderTargetsFallback",
+			Program: Program{
+				GlslVersion: GLSL100ES,
+				Varyings: []Type{
+					{Main: Vec2},
+				},
+				FragmentFunc: FragmentFunc{
+					OutParams: []Type{
+						{Main: Vec4},
+						{Main: Vec4},
+					},
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(2),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(1),
+						),
+					),
+				},
+			},
+			Glsl: `varying vec2 V0;
+#if defined(COMPILING_FRAGMENT_SHADER)
+void main(void) {
+	gl_FragData[0] = V0;
+	gl_FragData[1] = gl_FragCoord;
+}
+#endif`,
+		},
+		{
+			// GLSL 3.30 (and ES 3.00) spell the texture-sampling builtin
+			// "texture" rather than ES 1.00's "texture2D".
+			Name: "Glsl330Texture",
+			Program: Program{
+				GlslVersion: GLSL330,
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Vec2},
+						},
+						OutParams: []Type{
+							{Main: Vec4},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(1),
+								callExpr(
+									builtinFuncExpr(Texture2DF),
+									localVariableExpr(0),
+								),
+							),
+						),
+					},
+				},
+			},
+			Glsl: `#version 330
+void F0(in vec2 l0, out vec4 l1) {
+	l1 = (texture)(l0);
+}`,
+		},
 	}
 	for _, tc := range tests {
 		got := tc.Program.Glsl()
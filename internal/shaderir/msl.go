@@ -0,0 +1,430 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir
+
+import (
+	"fmt"
+	"strings"
+)
+
+func mslType(t Type, s *structSet) string {
+	switch t.Main {
+	case None:
+		return "void"
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Vec2:
+		return "float2"
+	case Vec3:
+		return "float3"
+	case Vec4:
+		return "float4"
+	case Mat2:
+		return "float2x2"
+	case Mat3:
+		return "float3x3"
+	case Mat4:
+		return "float4x4"
+	case Array:
+		return fmt.Sprintf("array<%s, %d>", mslType(t.Sub[0], s), t.Length)
+	case Struct:
+		return s.name(t)
+	default:
+		panic(fmt.Sprintf("shaderir: unexpected type: %d", t.Main))
+	}
+}
+
+var mslBuiltinFuncs = map[BuiltinFunc]string{
+	BoolF:       "bool",
+	IntF:        "int",
+	FloatF:      "float",
+	Vec2F:       "float2",
+	Vec3F:       "float3",
+	Vec4F:       "float4",
+	Mat2F:       "float2x2",
+	Mat3F:       "float3x3",
+	Mat4F:       "float4x4",
+	Min:         "min",
+	Max:         "max",
+	Mix:         "mix",
+	Clamp:       "clamp",
+	Abs:         "abs",
+	Pow:         "pow",
+	Exp:         "exp",
+	Log:         "log",
+	Sqrt:        "sqrt",
+	InverseSqrt: "rsqrt",
+	Floor:       "floor",
+	Ceil:        "ceil",
+	Fract:       "fract",
+	Mod:         "fmod",
+	Sin:         "sin",
+	Cos:         "cos",
+	Tan:         "tan",
+	Atan:        "atan",
+	Atan2:       "atan2",
+	Dot:         "dot",
+	Cross:       "cross",
+	Length:      "length",
+	Distance:    "distance",
+	Normalize:   "normalize",
+	Step:        "step",
+	Smoothstep:  "smoothstep",
+	Texture2DF:  "tex.sample",
+}
+
+type mslContext struct {
+	prog    *Program
+	structs *structSet
+	stage   glslStage
+}
+
+func (c *mslContext) reserved() int {
+	switch c.stage {
+	case glslStageVertex:
+		return len(c.prog.Attributes) + len(c.prog.Varyings) + 1
+	case glslStageFragment:
+		return len(c.prog.Varyings) + 1 + len(c.prog.FragmentFunc.OutParams)
+	default:
+		return 0
+	}
+}
+
+// localVarName mirrors glslContext.localVarName's index scheme, but
+// attributes and varyings are struct members in MSL ("in.A0", "out.V0")
+// rather than free-standing globals, the gl_Position/gl_FragCoord
+// analogues are the "position" member of the stage_in/stage_out struct,
+// and each FragmentFunc.OutParams slot is a member of the FragmentOut
+// struct the fragment function builds and returns.
+func (c *mslContext) localVarName(idx int) string {
+	switch c.stage {
+	case glslStageVertex:
+		nA := len(c.prog.Attributes)
+		nV := len(c.prog.Varyings)
+		switch {
+		case idx < nA:
+			return fmt.Sprintf("in.A%d", idx)
+		case idx < nA+nV:
+			return fmt.Sprintf("out.V%d", idx-nA)
+		case idx == nA+nV:
+			return "out.position"
+		default:
+			return fmt.Sprintf("l%d", idx-c.reserved())
+		}
+	case glslStageFragment:
+		nV := len(c.prog.Varyings)
+		nO := len(c.prog.FragmentFunc.OutParams)
+		switch {
+		case idx < nV:
+			return fmt.Sprintf("in.V%d", idx)
+		case idx == nV:
+			return "in.position"
+		case idx < nV+1+nO:
+			return fmt.Sprintf("out.Target%d", idx-(nV+1))
+		default:
+			return fmt.Sprintf("l%d", idx-c.reserved())
+		}
+	default:
+		return fmt.Sprintf("l%d", idx)
+	}
+}
+
+func (c *mslContext) expr(e Expr) string {
+	switch e.Type {
+	case FloatExpr:
+		return fmt.Sprintf("%.9e", e.Float)
+	case UniformVariable:
+		return fmt.Sprintf("U%d", e.Index)
+	case LocalVariable:
+		return c.localVarName(e.Index)
+	case BuiltinFuncExpr:
+		return mslBuiltinFuncs[e.BuiltinFunc]
+	case SwizzlingExpr:
+		return e.Swizzling
+	case FunctionExpr:
+		return fmt.Sprintf("F%d", e.Index)
+	case Binary:
+		return fmt.Sprintf("(%s) %s (%s)", c.expr(e.Exprs[0]), glslOps[e.Op], c.expr(e.Exprs[1]))
+	case Selection:
+		return fmt.Sprintf("(%s) ? (%s) : (%s)", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]), c.expr(e.Exprs[2]))
+	case Call:
+		args := make([]string, len(e.Exprs)-1)
+		for i, a := range e.Exprs[1:] {
+			args[i] = c.expr(a)
+		}
+		if callee := e.Exprs[0]; callee.Type == BuiltinFuncExpr {
+			switch callee.BuiltinFunc {
+			case Texture2DF:
+				// texture2d<float> has no call syntax of its own: sampling
+				// is the instance method tex.sample(sampler, uv). tex and
+				// texSampler are the [[texture(0)]]/[[sampler(0)]] arguments
+				// mslTextureParams adds to any function that samples.
+				return fmt.Sprintf("tex.sample(texSampler, %s)", strings.Join(args, ", "))
+			case BoolF, IntF, FloatF, Vec2F, Vec3F, Vec4F, Mat2F, Mat3F, Mat4F:
+				// mslBuiltinFuncs maps these to type names (float4, ...),
+				// and Metal has no (type)(args) constructor syntax: wrapping
+				// the type in parens makes it a C++-style cast applied to
+				// the comma-expression (args), which silently drops every
+				// argument but the last. Call the type name directly.
+				return fmt.Sprintf("%s(%s)", mslBuiltinFuncs[callee.BuiltinFunc], strings.Join(args, ", "))
+			case Mod:
+				// Metal's fmod is truncated, but the IR's Mod is floored
+				// (see its doc comment): expand rather than call fmod
+				// directly.
+				return fmt.Sprintf("(%s) - (%s) * floor((%s) / (%s))", args[0], args[1], args[0], args[1])
+			}
+		}
+		return fmt.Sprintf("(%s)(%s)", c.expr(e.Exprs[0]), strings.Join(args, ", "))
+	case FieldSelector:
+		return fmt.Sprintf("(%s).%s", c.expr(e.Exprs[0]), c.expr(e.Exprs[1]))
+	default:
+		panic(fmt.Sprintf("shaderir: unexpected expr type: %d", e.Type))
+	}
+}
+
+func (c *mslContext) block(b Block, idx, level int) (string, int) {
+	ind := strings.Repeat("\t", level)
+	var lines []string
+
+	for _, t := range b.LocalVars {
+		lines = append(lines, fmt.Sprintf("%s%s %s;", ind, mslType(t, c.structs), c.localVarName(idx)))
+		idx++
+	}
+
+	for _, stmt := range b.Stmts {
+		switch stmt.Type {
+		case BlockStmt:
+			inner, next := c.block(stmt.Blocks[0], idx, level+1)
+			lines = append(lines, ind+"{")
+			if inner != "" {
+				lines = append(lines, inner)
+			}
+			lines = append(lines, ind+"}")
+			idx = next
+		case If:
+			then, next := c.block(stmt.Blocks[0], idx, level+1)
+			idx = next
+			lines = append(lines, fmt.Sprintf("%sif (%s) {", ind, c.expr(stmt.Exprs[0])))
+			if then != "" {
+				lines = append(lines, then)
+			}
+			if len(stmt.Blocks) > 1 && (len(stmt.Blocks[1].Stmts) > 0 || len(stmt.Blocks[1].LocalVars) > 0) {
+				els, next := c.block(stmt.Blocks[1], idx, level+1)
+				idx = next
+				lines = append(lines, ind+"} else {")
+				if els != "" {
+					lines = append(lines, els)
+				}
+			}
+			lines = append(lines, ind+"}")
+		case For:
+			loopIdx := idx
+			idx++
+			body, next := c.block(stmt.Blocks[0], idx, level+1)
+			idx = next
+			name := c.localVarName(loopIdx)
+			lines = append(lines, fmt.Sprintf("%sfor (int %s = %d; %s %s %d; %s%s) {",
+				ind, name, stmt.ForInit, name, glslOps[stmt.ForOp], stmt.ForEnd, name, glslForDelta(stmt.ForDelta)))
+			if body != "" {
+				lines = append(lines, body)
+			}
+			lines = append(lines, ind+"}")
+		case Assign:
+			lines = append(lines, fmt.Sprintf("%s%s = %s;", ind, c.expr(stmt.Exprs[0]), c.expr(stmt.Exprs[1])))
+		case ExprStmt:
+			lines = append(lines, ind+c.expr(stmt.Exprs[0])+";")
+		case Return:
+			if len(stmt.Exprs) > 0 {
+				lines = append(lines, ind+"return "+c.expr(stmt.Exprs[0])+";")
+			} else {
+				lines = append(lines, ind+"return;")
+			}
+		case Continue:
+			lines = append(lines, ind+"continue;")
+		case Break:
+			lines = append(lines, ind+"break;")
+		}
+	}
+
+	return strings.Join(lines, "\n"), idx
+}
+
+func (c *mslContext) params(f Func) string {
+	var params []string
+	idx := 0
+	add := func(qualifier string, t Type) {
+		if qualifier == "" {
+			params = append(params, fmt.Sprintf("%s l%d", mslType(t, c.structs), idx))
+		} else {
+			params = append(params, fmt.Sprintf("thread %s& l%d /* %s */", mslType(t, c.structs), idx, qualifier))
+		}
+		idx++
+	}
+	for _, t := range f.InParams {
+		add("", t)
+	}
+	for _, t := range f.InOutParams {
+		add("inout", t)
+	}
+	for _, t := range f.OutParams {
+		add("out", t)
+	}
+	if blockUsesTexture2DF(f.Block) {
+		params = append(params, mslTextureParams...)
+	}
+	return strings.Join(params, ", ")
+}
+
+// mslTextureParams are the [[texture(0)]]/[[sampler(0)]] arguments any
+// function that calls Texture2DF needs: unlike HLSL, Metal has no global
+// resource bindings, so the texture and its sampler must be threaded in
+// through the function signature.
+var mslTextureParams = []string{"texture2d<float> tex [[texture(0)]]", "sampler texSampler [[sampler(0)]]"}
+
+func (c *mslContext) funcDecl(f Func) string {
+	retType := "void"
+	if f.Return.Main != None {
+		retType = mslType(f.Return, c.structs)
+	}
+	header := fmt.Sprintf("%s F%d(%s) {", retType, f.Index, c.params(f))
+
+	startIdx := len(f.InParams) + len(f.InOutParams) + len(f.OutParams)
+	body, _ := c.block(f.Block, startIdx, 1)
+
+	lines := []string{header}
+	if body != "" {
+		lines = append(lines, body)
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+func mslVertexInDecl(p *Program, s *structSet) string {
+	if len(p.Attributes) == 0 {
+		return ""
+	}
+	lines := []string{"struct VertexIn {"}
+	for i, t := range p.Attributes {
+		lines = append(lines, fmt.Sprintf("\t%s A%d [[attribute(%d)]];", mslType(t, s), i, i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+// mslFragmentOutDecl declares the fragment stage's output struct, one
+// [[color(N)]]-tagged member per FragmentFunc.OutParams entry (multiple
+// entries mean multiple render targets).
+func mslFragmentOutDecl(p *Program, s *structSet) string {
+	lines := []string{"struct FragmentOut {"}
+	for i, t := range p.FragmentFunc.OutParams {
+		lines = append(lines, fmt.Sprintf("\t%s Target%d [[color(%d)]];", mslType(t, s), i, i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+func mslVaryingsDecl(p *Program, s *structSet) string {
+	lines := []string{"struct Varyings {", "\tfloat4 position [[position]];"}
+	for i, t := range p.Varyings {
+		lines = append(lines, fmt.Sprintf("\t%s V%d [[user(locn%d)]];", mslType(t, s), i, i))
+	}
+	lines = append(lines, "};")
+	return strings.Join(lines, "\n")
+}
+
+// Msl compiles the program to the Metal Shading Language, so it can drive a
+// Metal render pipeline directly instead of going through an OpenGL-to-Metal
+// translation layer. Attributes and varyings are gathered into VertexIn and
+// Varyings structs, as Metal's [[stage_in]] binding requires, and gl_Position
+// becomes the struct's [[position]] member.
+func (p *Program) Msl() string {
+	s := p.collectStructs()
+	var lines []string
+
+	for _, t := range s.order {
+		l := []string{fmt.Sprintf("struct %s {", s.name(t))}
+		for i, f := range t.Sub {
+			l = append(l, fmt.Sprintf("\t%s M%d;", mslType(f, s), i))
+		}
+		l = append(l, "};")
+		lines = append(lines, strings.Join(l, "\n"))
+	}
+
+	if in := mslVertexInDecl(p, s); in != "" {
+		lines = append(lines, in)
+	}
+	if glslDefined(p.VertexFunc.Block) || glslDefined(p.FragmentFunc.Block) || len(p.Varyings) > 0 {
+		lines = append(lines, mslVaryingsDecl(p, s))
+	}
+
+	fctx := &mslContext{prog: p, structs: s, stage: glslStageNone}
+	for _, f := range p.Funcs {
+		lines = append(lines, fctx.funcDecl(f))
+	}
+
+	uniformParams := func() string {
+		var ps []string
+		for i, t := range p.Uniforms {
+			ps = append(ps, fmt.Sprintf("constant %s& U%d [[buffer(%d)]]", mslType(t, s), i, i))
+		}
+		return strings.Join(ps, ", ")
+	}()
+
+	if glslDefined(p.VertexFunc.Block) {
+		c := &mslContext{prog: p, structs: s, stage: glslStageVertex}
+		body, _ := c.block(p.VertexFunc.Block, c.reserved(), 1)
+
+		params := "VertexIn in [[stage_in]]"
+		if uniformParams != "" {
+			params += ", " + uniformParams
+		}
+		if blockUsesTexture2DF(p.VertexFunc.Block) {
+			params += ", " + strings.Join(mslTextureParams, ", ")
+		}
+		vLines := []string{fmt.Sprintf("vertex Varyings Vertex(%s) {", params), "\tVaryings out;"}
+		if body != "" {
+			vLines = append(vLines, body)
+		}
+		vLines = append(vLines, "\treturn out;", "}")
+		lines = append(lines, strings.Join(vLines, "\n"))
+	}
+
+	if glslDefined(p.FragmentFunc.Block) {
+		c := &mslContext{prog: p, structs: s, stage: glslStageFragment}
+		body, _ := c.block(p.FragmentFunc.Block, c.reserved(), 1)
+
+		lines = append(lines, mslFragmentOutDecl(p, s))
+
+		params := "Varyings in [[stage_in]]"
+		if uniformParams != "" {
+			params += ", " + uniformParams
+		}
+		if blockUsesTexture2DF(p.FragmentFunc.Block) {
+			params += ", " + strings.Join(mslTextureParams, ", ")
+		}
+		fLines := []string{fmt.Sprintf("fragment FragmentOut Fragment(%s) {", params), "\tFragmentOut out;"}
+		if body != "" {
+			fLines = append(fLines, body)
+		}
+		fLines = append(fLines, "\treturn out;", "}")
+		lines = append(lines, strings.Join(fLines, "\n"))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir_test
+
+import (
+	"testing"
+
+	. "github.com/hajimehoshi/ebiten/internal/shaderir"
+)
+
+func TestOutputMsl(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Program Program
+		Msl     string
+	}{
+		{
+			Name:    "Empty",
+			Program: Program{},
+			Msl:     ``,
+		},
+		{
+			Name: "UniformStruct",
+			Program: Program{
+				Uniforms: []Type{
+					{
+						Main: Struct,
+						Sub: []Type{
+							{Main: Float},
+						},
+					},
+				},
+			},
+			Msl: `struct S0 {
+	float M0;
+};`,
+		},
+		{
+			Name: "Add",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Float},
+							{Main: Float},
+						},
+						OutParams: []Type{
+							{Main: Float},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(2),
+								binaryExpr(
+									Add,
+									localVariableExpr(0),
+									localVariableExpr(1),
+								),
+							),
+						),
+					},
+				},
+			},
+			Msl: `void F0(float l0, float l1, thread float& l2 /* out */) {
+	l2 = (l0) + (l1);
+}`,
+		},
+		{
+			// VertexFunc+FragmentFunc round-trip: the vertex stage writes
+			// gl_Position and the varyings, and the fragment stage reads
+			// them back through the same Varyings struct and writes a real
+			// color to its single render target.
+			Name: "VertexAndFragmentFunc",
+			Program: Program{
+				Attributes: []Type{
+					{Main: Vec4},
+					{Main: Vec2},
+				},
+				Varyings: []Type{
+					{Main: Vec2},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(2),
+							localVariableExpr(1),
+						),
+					),
+				},
+				FragmentFunc: FragmentFunc{
+					OutParams: []Type{
+						{Main: Vec4},
+					},
+					Block: block(
+						[]Type{
+							{Main: Vec2},
+						},
+						assignStmt(
+							localVariableExpr(3),
+							localVariableExpr(0),
+						),
+						assignStmt(
+							localVariableExpr(2),
+							callExpr(builtinFuncExpr(Vec4F), localVariableExpr(3), floatExpr(0), floatExpr(1)),
+						),
+					),
+				},
+			},
+			Msl: `struct VertexIn {
+	float4 A0 [[attribute(0)]];
+	float2 A1 [[attribute(1)]];
+};
+struct Varyings {
+	float4 position [[position]];
+	float2 V0 [[user(locn0)]];
+};
+vertex Varyings Vertex(VertexIn in [[stage_in]]) {
+	Varyings out;
+	out.position = in.A0;
+	out.V0 = in.A1;
+	return out;
+}
+struct FragmentOut {
+	float4 Target0 [[color(0)]];
+};
+fragment FragmentOut Fragment(Varyings in [[stage_in]]) {
+	FragmentOut out;
+	float2 l0;
+	l0 = in.V0;
+	out.Target0 = float4(l0, 0.000000000e+00, 1.000000000e+00);
+	return out;
+}`,
+		},
+		{
+			// Texture2DF lowers to tex.sample against texture/sampler
+			// arguments threaded into the function signature, since Metal
+			// has no global resource bindings the way HLSL does.
+			Name: "TextureSample",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Vec2},
+						},
+						OutParams: []Type{
+							{Main: Vec4},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(1),
+								callExpr(builtinFuncExpr(Texture2DF), localVariableExpr(0)),
+							),
+						),
+					},
+				},
+			},
+			Msl: `void F0(float2 l0, thread float4& l1 /* out */, texture2d<float> tex [[texture(0)]], sampler texSampler [[sampler(0)]]) {
+	l1 = tex.sample(texSampler, l0);
+}`,
+		},
+		{
+			// Mod is floored, unlike Metal's truncated fmod, so it must
+			// expand to the floored formula rather than call fmod directly.
+			Name: "Mod",
+			Program: Program{
+				Funcs: []Func{
+					{
+						Index: 0,
+						InParams: []Type{
+							{Main: Float},
+							{Main: Float},
+						},
+						OutParams: []Type{
+							{Main: Float},
+						},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(2),
+								callExpr(builtinFuncExpr(Mod), localVariableExpr(0), localVariableExpr(1)),
+							),
+						),
+					},
+				},
+			},
+			Msl: `void F0(float l0, float l1, thread float& l2 /* out */) {
+	l2 = (l0) - (l1) * floor((l0) / (l1));
+}`,
+		},
+	}
+	for _, tc := range tests {
+		got := tc.Program.Msl()
+		want := tc.Msl + "\n"
+		if got != want {
+			t.Errorf("%s: got: %s, want: %s", tc.Name, got, want)
+		}
+	}
+}
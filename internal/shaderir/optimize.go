@@ -0,0 +1,689 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir
+
+// Optimize runs a constant-folding, strength-reduction, and dead-code
+// elimination pass over p before any backend emitter sees it. Glsl, Msl,
+// Hlsl, and Spirv all walk the same IR, so collapsing constant
+// subexpressions and dropping unread locals here benefits every backend
+// uniformly instead of depending on each target's driver or assembler to
+// do it on its own.
+func Optimize(p Program) Program {
+	if len(p.Funcs) > 0 {
+		fs := make([]Func, len(p.Funcs))
+		for i, f := range p.Funcs {
+			start := len(f.InParams) + len(f.InOutParams) + len(f.OutParams)
+			f.Block = optimizeFuncBlock(f.Block, start)
+			fs[i] = f
+		}
+		p.Funcs = fs
+	}
+
+	p.VertexFunc.Block = optimizeEntryBlock(p, p.VertexFunc.Block, glslStageVertex)
+	p.FragmentFunc.Block = optimizeEntryBlock(p, p.FragmentFunc.Block, glslStageFragment)
+	p.ComputeFunc.Block = optimizeEntryBlock(p, p.ComputeFunc.Block, glslStageCompute)
+
+	return p
+}
+
+// optimizeEntryBlock optimizes one of the program's entry-point blocks.
+// Attributes, varyings, and the stage's built-in value reserve the low
+// local-variable indices exactly as glslContext.reserved (and its Msl/Hlsl
+// counterparts) compute them, so reindexing has to start past those.
+func optimizeEntryBlock(p Program, b Block, stage glslStage) Block {
+	if !glslDefined(b) {
+		return b
+	}
+	c := &glslContext{prog: &p, stage: stage}
+	return optimizeFuncBlock(b, c.reserved())
+}
+
+// optimizeFuncBlock folds constants and drops dead branches in b, removes
+// individual stores whose value is never read before they're overwritten,
+// then removes locals that are never read at all and renumbers what
+// remains so local indices stay contiguous from start.
+//
+// b is deep-copied up front: every pass below rewrites Exprs/Stmts in
+// place, and Block/Stmt/Expr are plain structs whose slice fields would
+// otherwise still point at the caller's backing arrays, corrupting the
+// Program passed into Optimize.
+func optimizeFuncBlock(b Block, start int) Block {
+	b = deepCopyBlock(b)
+	b = optimizeBlock(b)
+	b = removeDeadStores(b, start)
+
+	declared := map[int]bool{}
+	idx := start
+	collectDeclaredLocals(b, &idx, declared)
+
+	read := map[int]bool{}
+	unsafeWrite := map[int]bool{}
+	collectLocalVarInfo(b, read, unsafeWrite)
+
+	dead := map[int]bool{}
+	for i := range declared {
+		if !read[i] && !unsafeWrite[i] {
+			dead[i] = true
+		}
+	}
+
+	st := &reindexState{dead: dead, remap: map[int]int{}, oldIdx: start, newIdx: start}
+	return st.processBlock(b)
+}
+
+// deepCopyBlock clones b and everything it references (LocalVars,
+// SharedVars, and every nested Stmt/Expr/Block), so rewriting the copy
+// never touches the original's backing arrays.
+func deepCopyBlock(b Block) Block {
+	nb := Block{
+		SharedVars: append([]Type(nil), b.SharedVars...),
+		LocalVars:  append([]Type(nil), b.LocalVars...),
+	}
+	if b.Stmts != nil {
+		nb.Stmts = make([]Stmt, len(b.Stmts))
+		for i, s := range b.Stmts {
+			nb.Stmts[i] = deepCopyStmt(s)
+		}
+	}
+	return nb
+}
+
+func deepCopyStmt(s Stmt) Stmt {
+	if s.Exprs != nil {
+		exprs := make([]Expr, len(s.Exprs))
+		for i, e := range s.Exprs {
+			exprs[i] = deepCopyExpr(e)
+		}
+		s.Exprs = exprs
+	}
+	if s.Blocks != nil {
+		blocks := make([]Block, len(s.Blocks))
+		for i, b := range s.Blocks {
+			blocks[i] = deepCopyBlock(b)
+		}
+		s.Blocks = blocks
+	}
+	return s
+}
+
+func deepCopyExpr(e Expr) Expr {
+	if e.Exprs != nil {
+		exprs := make([]Expr, len(e.Exprs))
+		for i, c := range e.Exprs {
+			exprs[i] = deepCopyExpr(c)
+		}
+		e.Exprs = exprs
+	}
+	return e
+}
+
+// optimizeBlock folds constant expressions throughout b and removes if
+// statements whose condition folds to a compile-time constant, keeping
+// (and flattening) only the branch that's actually taken.
+func optimizeBlock(b Block) Block {
+	b.Stmts = optimizeStmts(b.Stmts)
+	return b
+}
+
+func optimizeStmts(stmts []Stmt) []Stmt {
+	var out []Stmt
+	for _, stmt := range stmts {
+		out = append(out, optimizeStmt(stmt)...)
+	}
+	return out
+}
+
+func optimizeStmt(stmt Stmt) []Stmt {
+	for i := range stmt.Exprs {
+		stmt.Exprs[i] = foldExpr(stmt.Exprs[i])
+	}
+
+	if stmt.Type == If {
+		then := optimizeBlock(stmt.Blocks[0])
+		hasElse := len(stmt.Blocks) > 1
+		var els Block
+		if hasElse {
+			els = optimizeBlock(stmt.Blocks[1])
+		}
+
+		if v, ok := constCondition(stmt.Exprs[0]); ok {
+			if v {
+				return wrapIfDefined(then)
+			}
+			if hasElse {
+				return wrapIfDefined(els)
+			}
+			return nil
+		}
+
+		stmt.Blocks[0] = then
+		if hasElse {
+			stmt.Blocks[1] = els
+		}
+		return []Stmt{stmt}
+	}
+
+	for i := range stmt.Blocks {
+		stmt.Blocks[i] = optimizeBlock(stmt.Blocks[i])
+	}
+	return []Stmt{stmt}
+}
+
+// wrapIfDefined wraps b in a BlockStmt so a resolved if's surviving branch
+// keeps its own local-variable scope, or drops it entirely if it has
+// nothing in it.
+func wrapIfDefined(b Block) []Stmt {
+	if !glslDefined(b) {
+		return nil
+	}
+	return []Stmt{{Type: BlockStmt, Blocks: []Block{b}}}
+}
+
+// constCondition evaluates a comparison of two constant operands at
+// compile time, so that "if (true)"/"if (false)" branches (spelled here as
+// comparisons between literals, e.g. 1.0 < 2.0) can be resolved away.
+func constCondition(e Expr) (v bool, ok bool) {
+	if e.Type != Binary || len(e.Exprs) != 2 {
+		return false, false
+	}
+	l, lok := floatLiteral(e.Exprs[0])
+	r, rok := floatLiteral(e.Exprs[1])
+	if !lok || !rok {
+		return false, false
+	}
+	switch e.Op {
+	case LessThanOp:
+		return l < r, true
+	case LessThanEqualOp:
+		return l <= r, true
+	case GreaterThanOp:
+		return l > r, true
+	case GreaterThanEqualOp:
+		return l >= r, true
+	case EqualOp:
+		return l == r, true
+	case NotEqualOp:
+		return l != r, true
+	default:
+		return false, false
+	}
+}
+
+// foldExpr folds e's children and then e itself, bottom-up.
+func foldExpr(e Expr) Expr {
+	for i := range e.Exprs {
+		e.Exprs[i] = foldExpr(e.Exprs[i])
+	}
+
+	switch e.Type {
+	case Binary:
+		return foldBinary(e)
+	case Call:
+		return foldCall(e)
+	case FieldSelector:
+		return foldFieldSelector(e)
+	default:
+		return e
+	}
+}
+
+func floatLiteral(e Expr) (float32, bool) {
+	if e.Type != FloatExpr {
+		return 0, false
+	}
+	return e.Float, true
+}
+
+func isFloatLiteralValue(e Expr, v float32) bool {
+	f, ok := floatLiteral(e)
+	return ok && f == v
+}
+
+func floatExprVal(v float32) Expr {
+	return Expr{Type: FloatExpr, Float: v}
+}
+
+// foldBinary constant-folds a binary expression whose operands are both
+// float literals, and otherwise applies strength reduction against the
+// operator's identity element (x*1.0, 1.0*x, x+0.0, 0.0+x, x-0.0, x/1.0).
+func foldBinary(e Expr) Expr {
+	l, r := e.Exprs[0], e.Exprs[1]
+
+	if lv, ok := floatLiteral(l); ok {
+		if rv, ok := floatLiteral(r); ok {
+			switch e.Op {
+			case Add:
+				return floatExprVal(lv + rv)
+			case Sub:
+				return floatExprVal(lv - rv)
+			case Mul:
+				return floatExprVal(lv * rv)
+			case Div:
+				if rv != 0 {
+					return floatExprVal(lv / rv)
+				}
+			}
+		}
+	}
+
+	switch e.Op {
+	case Mul:
+		if isFloatLiteralValue(r, 1) {
+			return l
+		}
+		if isFloatLiteralValue(l, 1) {
+			return r
+		}
+	case Add:
+		if isFloatLiteralValue(r, 0) {
+			return l
+		}
+		if isFloatLiteralValue(l, 0) {
+			return r
+		}
+	case Sub:
+		if isFloatLiteralValue(r, 0) {
+			return l
+		}
+	case Div:
+		if isFloatLiteralValue(r, 1) {
+			return l
+		}
+	}
+
+	return e
+}
+
+// foldCall constant-folds a call to a built-in function when every
+// argument is a float literal.
+func foldCall(e Expr) Expr {
+	callee := e.Exprs[0]
+	if callee.Type != BuiltinFuncExpr {
+		return e
+	}
+
+	args := e.Exprs[1:]
+	vals := make([]float32, len(args))
+	for i, a := range args {
+		v, ok := floatLiteral(a)
+		if !ok {
+			return e
+		}
+		vals[i] = v
+	}
+
+	switch callee.BuiltinFunc {
+	case Min:
+		if len(vals) == 2 {
+			if vals[0] < vals[1] {
+				return floatExprVal(vals[0])
+			}
+			return floatExprVal(vals[1])
+		}
+	case Max:
+		if len(vals) == 2 {
+			if vals[0] > vals[1] {
+				return floatExprVal(vals[0])
+			}
+			return floatExprVal(vals[1])
+		}
+	}
+
+	return e
+}
+
+// foldFieldSelector rewrites a swizzle of a vector constructor call whose
+// arguments are all float literals, e.g. vec4(1,1,1,1).xy, into a constructor of the swizzled size built directly
+// from the selected component expressions, e.g. vec2(1,1). This collapses
+// the common case of a larger vector being built only to immediately
+// narrow it back down.
+func foldFieldSelector(e Expr) Expr {
+	target, sel := e.Exprs[0], e.Exprs[1]
+	if sel.Type != SwizzlingExpr {
+		return e
+	}
+	if target.Type != Call || target.Exprs[0].Type != BuiltinFuncExpr {
+		return e
+	}
+	switch target.Exprs[0].BuiltinFunc {
+	case Vec2F, Vec3F, Vec4F:
+	default:
+		return e
+	}
+	args := target.Exprs[1:]
+	for _, a := range args {
+		if a.Type != FloatExpr {
+			return e
+		}
+	}
+
+	comps := make([]Expr, 0, len(sel.Swizzling))
+	for i := 0; i < len(sel.Swizzling); i++ {
+		j, ok := swizzleIndex(sel.Swizzling[i])
+		if !ok || j >= len(args) {
+			return e
+		}
+		comps = append(comps, args[j])
+	}
+
+	var ctor BuiltinFunc
+	switch len(comps) {
+	case 1:
+		ctor = FloatF
+	case 2:
+		ctor = Vec2F
+	case 3:
+		ctor = Vec3F
+	case 4:
+		ctor = Vec4F
+	default:
+		return e
+	}
+
+	return Expr{
+		Type:  Call,
+		Exprs: append([]Expr{{Type: BuiltinFuncExpr, BuiltinFunc: ctor}}, comps...),
+	}
+}
+
+func swizzleIndex(c byte) (int, bool) {
+	switch c {
+	case 'x':
+		return 0, true
+	case 'y':
+		return 1, true
+	case 'z':
+		return 2, true
+	case 'w':
+		return 3, true
+	default:
+		return -1, false
+	}
+}
+
+// hasSideEffect reports whether evaluating e can observably affect
+// anything beyond its own result: an atomic read-modify-write, or a call
+// to a user-defined function (which might write to an InOut/Out
+// parameter). A dead-looking assignment with such a right-hand side must
+// still run for its side effect, so it's never eligible for removal.
+func hasSideEffect(e Expr) bool {
+	switch e.Type {
+	case Atomic:
+		return true
+	case Call:
+		if e.Exprs[0].Type == FunctionExpr {
+			return true
+		}
+	}
+	for _, c := range e.Exprs {
+		if hasSideEffect(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDeadStores drops an Assign to a bare local whose value is never
+// read before either a later write to the same local or the end of the
+// function — catching a dead store even when that same local is read
+// earlier on, which collectLocalVarInfo's whole-function "is it read
+// anywhere" check below can't distinguish from a live one.
+//
+// It's a backward liveness scan: a read downstream keeps a store alive,
+// and reaching an earlier write to the same local without seeing a read
+// first means the earlier write (or, run at the end of a branch, every
+// write still pending) was dead. If's two branches merge their liveness
+// by union, since either might run. A For loop's body is left alone:
+// its own live-out also feeds back into its next iteration, which a
+// single backward pass can't account for, so the loop is instead treated
+// as reading every local it references, conservatively keeping
+// every store it or anything after it might depend on.
+func removeDeadStores(b Block, start int) Block {
+	b, _ = removeDeadStoresBlock(b, map[int]bool{}, start)
+	return b
+}
+
+func removeDeadStoresBlock(b Block, liveOut map[int]bool, start int) (Block, map[int]bool) {
+	live := copyIntSet(liveOut)
+	kept := make([]Stmt, 0, len(b.Stmts))
+
+	for i := len(b.Stmts) - 1; i >= 0; i-- {
+		stmt := b.Stmts[i]
+
+		switch stmt.Type {
+		case Assign:
+			lhs, rhs := stmt.Exprs[0], stmt.Exprs[1]
+			// Indices below start are reserved attribute/varying/built-in/
+			// param/out slots (see collectDeclaredLocals): they're read by
+			// whatever's outside this function, not by another Stmt here,
+			// so they're never eligible for dead-store removal.
+			if lhs.Type == LocalVariable && lhs.Index >= start && !hasSideEffect(rhs) && !live[lhs.Index] {
+				continue
+			}
+			if lhs.Type == LocalVariable {
+				delete(live, lhs.Index)
+			} else {
+				addExprReads(lhs, live)
+			}
+			addExprReads(rhs, live)
+		case If:
+			then, thenLive := removeDeadStoresBlock(stmt.Blocks[0], live, start)
+			stmt.Blocks[0] = then
+			merged := unionIntSets(thenLive, live)
+			if len(stmt.Blocks) > 1 {
+				els, elsLive := removeDeadStoresBlock(stmt.Blocks[1], live, start)
+				stmt.Blocks[1] = els
+				merged = unionIntSets(thenLive, elsLive)
+			}
+			live = merged
+			addExprReads(stmt.Exprs[0], live)
+		case BlockStmt:
+			inner, innerLive := removeDeadStoresBlock(stmt.Blocks[0], live, start)
+			stmt.Blocks[0] = inner
+			live = innerLive
+		case For:
+			refs := map[int]bool{}
+			collectAllLocalRefs(stmt.Blocks[0], refs)
+			for idx := range refs {
+				live[idx] = true
+			}
+		default:
+			for _, e := range stmt.Exprs {
+				addExprReads(e, live)
+			}
+			for _, blk := range stmt.Blocks {
+				refs := map[int]bool{}
+				collectAllLocalRefs(blk, refs)
+				for idx := range refs {
+					live[idx] = true
+				}
+			}
+		}
+
+		kept = append([]Stmt{stmt}, kept...)
+	}
+
+	b.Stmts = kept
+	return b, live
+}
+
+func addExprReads(e Expr, live map[int]bool) {
+	if e.Type == LocalVariable {
+		live[e.Index] = true
+	}
+	for _, c := range e.Exprs {
+		addExprReads(c, live)
+	}
+}
+
+func copyIntSet(m map[int]bool) map[int]bool {
+	out := make(map[int]bool, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func unionIntSets(a, b map[int]bool) map[int]bool {
+	out := copyIntSet(a)
+	for k, v := range b {
+		if v {
+			out[k] = true
+		}
+	}
+	return out
+}
+
+// collectAllLocalRefs records every local-variable index referenced
+// anywhere in b, whether read, written, or nested inside a sub-block.
+func collectAllLocalRefs(b Block, refs map[int]bool) {
+	for _, stmt := range b.Stmts {
+		for _, e := range stmt.Exprs {
+			addExprReads(e, refs)
+		}
+		for _, blk := range stmt.Blocks {
+			collectAllLocalRefs(blk, refs)
+		}
+	}
+}
+
+// collectDeclaredLocals walks b in the same order glslContext.block assigns
+// local-variable indices, recording which indices come from a Block's
+// LocalVars (as opposed to a For statement's implicit, undeclared loop
+// counter, which is never a dead-code-elimination candidate).
+func collectDeclaredLocals(b Block, idx *int, declared map[int]bool) {
+	*idx += len(b.SharedVars)
+
+	for range b.LocalVars {
+		declared[*idx] = true
+		*idx++
+	}
+
+	for _, stmt := range b.Stmts {
+		if stmt.Type == For {
+			*idx++
+		}
+		for _, blk := range stmt.Blocks {
+			collectDeclaredLocals(blk, idx, declared)
+		}
+	}
+}
+
+// collectLocalVarInfo walks b recording, for every local-variable index:
+// in read, whether it's ever read; in unsafeWrite, whether any assignment
+// to it (as a bare local, not e.g. a swizzled component of one) has a
+// side-effecting right-hand side.
+func collectLocalVarInfo(b Block, read, unsafeWrite map[int]bool) {
+	for _, stmt := range b.Stmts {
+		if stmt.Type == Assign {
+			lhs, rhs := stmt.Exprs[0], stmt.Exprs[1]
+			collectReadsExpr(rhs, read)
+			if lhs.Type == LocalVariable {
+				if hasSideEffect(rhs) {
+					unsafeWrite[lhs.Index] = true
+				}
+			} else {
+				collectReadsExpr(lhs, read)
+			}
+		} else {
+			for _, e := range stmt.Exprs {
+				collectReadsExpr(e, read)
+			}
+		}
+		for _, blk := range stmt.Blocks {
+			collectLocalVarInfo(blk, read, unsafeWrite)
+		}
+	}
+}
+
+func collectReadsExpr(e Expr, read map[int]bool) {
+	if e.Type == LocalVariable {
+		read[e.Index] = true
+	}
+	for _, c := range e.Exprs {
+		collectReadsExpr(c, read)
+	}
+}
+
+// reindexState drops dead local-variable slots while walking a function
+// block and assigns the survivors contiguous indices, mirroring the same
+// traversal glslContext.block (and its Msl/Hlsl counterparts) use so the
+// result stays valid input to every backend.
+type reindexState struct {
+	dead   map[int]bool
+	remap  map[int]int
+	oldIdx int
+	newIdx int
+}
+
+func (st *reindexState) processBlock(b Block) Block {
+	var shared []Type
+	for _, t := range b.SharedVars {
+		st.remap[st.oldIdx] = st.newIdx
+		shared = append(shared, t)
+		st.oldIdx++
+		st.newIdx++
+	}
+
+	var locals []Type
+	for _, t := range b.LocalVars {
+		old := st.oldIdx
+		if !st.dead[old] {
+			st.remap[old] = st.newIdx
+			locals = append(locals, t)
+			st.newIdx++
+		}
+		st.oldIdx++
+	}
+
+	var stmts []Stmt
+	for _, stmt := range b.Stmts {
+		if stmt.Type == Assign && stmt.Exprs[0].Type == LocalVariable && st.dead[stmt.Exprs[0].Index] {
+			continue
+		}
+		stmts = append(stmts, st.processStmt(stmt))
+	}
+
+	return Block{SharedVars: shared, LocalVars: locals, Stmts: stmts}
+}
+
+func (st *reindexState) processStmt(stmt Stmt) Stmt {
+	for i := range stmt.Exprs {
+		stmt.Exprs[i] = st.remapExpr(stmt.Exprs[i])
+	}
+
+	if stmt.Type == For {
+		st.remap[st.oldIdx] = st.newIdx
+		st.oldIdx++
+		st.newIdx++
+	}
+
+	for i := range stmt.Blocks {
+		stmt.Blocks[i] = st.processBlock(stmt.Blocks[i])
+	}
+	return stmt
+}
+
+func (st *reindexState) remapExpr(e Expr) Expr {
+	if e.Type == LocalVariable {
+		if n, ok := st.remap[e.Index]; ok {
+			e.Index = n
+		}
+	}
+	for i := range e.Exprs {
+		e.Exprs[i] = st.remapExpr(e.Exprs[i])
+	}
+	return e
+}
@@ -0,0 +1,313 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	. "github.com/hajimehoshi/ebiten/internal/shaderir"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		Name string
+		In   Program
+		Out  Program
+		Glsl string
+	}{
+		{
+			// (2.0) + (3.0) folds to the single literal 5.0.
+			Name: "ConstantFoldBinary",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(0), binaryExpr(Add, floatExpr(2), floatExpr(3))),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(0), floatExpr(5)),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(out float l0) {
+	l0 = 5.000000000e+00;
+}`,
+		},
+		{
+			// (l0 * 1.0) + 0.0 strength-reduces away to just l0.
+			Name: "StrengthReduction",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						InParams:  []Type{{Main: Float}},
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(1),
+								binaryExpr(Add, binaryExpr(Mul, localVariableExpr(0), floatExpr(1)), floatExpr(0)),
+							),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						InParams:  []Type{{Main: Float}},
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(1), localVariableExpr(0)),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(in float l0, out float l1) {
+	l1 = l0;
+}`,
+		},
+		{
+			// min(1.0, 2.0) folds to the smaller literal.
+			Name: "ConstantFoldBuiltinCall",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(0), callExpr(builtinFuncExpr(Min), floatExpr(1), floatExpr(2))),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(0), floatExpr(1)),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(out float l0) {
+	l0 = 1.000000000e+00;
+}`,
+		},
+		{
+			// vec4(1,1,1,1).xy narrows straight to vec2(1,1) instead of
+			// building the larger vector just to immediately swizzle it down.
+			Name: "SwizzleOfConstructor",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Vec2}},
+						Block: block(
+							nil,
+							assignStmt(
+								localVariableExpr(0),
+								fieldSelectorExpr(
+									callExpr(builtinFuncExpr(Vec4F), floatExpr(1), floatExpr(1), floatExpr(1), floatExpr(1)),
+									swizzlingExpr("xy"),
+								),
+							),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Vec2}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(0), callExpr(builtinFuncExpr(Vec2F), floatExpr(1), floatExpr(1))),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(out vec2 l0) {
+	l0 = (vec2)(1.000000000e+00, 1.000000000e+00);
+}`,
+		},
+		{
+			// l2 is assigned but never read, so both its declaration and its
+			// store are removed; l1 is the out parameter and keeps its index.
+			Name: "DeadStoreElimination",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						InParams:  []Type{{Main: Float}},
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							[]Type{{Main: Float}},
+							assignStmt(localVariableExpr(2), floatExpr(1)),
+							assignStmt(localVariableExpr(1), localVariableExpr(0)),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						InParams:  []Type{{Main: Float}},
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							assignStmt(localVariableExpr(1), localVariableExpr(0)),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(in float l0, out float l1) {
+	l1 = l0;
+}`,
+		},
+		{
+			// l1 is read once after its first store, so that store survives.
+			// Its second store is never read by anything afterward and is
+			// removed on its own, without touching the first store or l1's
+			// declaration.
+			Name: "DeadStoreOfOverwrittenLocal",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							[]Type{{Main: Float}},
+							assignStmt(localVariableExpr(1), floatExpr(2)),
+							assignStmt(localVariableExpr(0), localVariableExpr(1)),
+							assignStmt(localVariableExpr(1), floatExpr(9)),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							[]Type{{Main: Float}},
+							assignStmt(localVariableExpr(1), floatExpr(2)),
+							assignStmt(localVariableExpr(0), localVariableExpr(1)),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(out float l0) {
+	float l1;
+	l1 = 2.000000000e+00;
+	l0 = l1;
+}`,
+		},
+		{
+			// The condition folds to the compile-time constant true, so the
+			// if collapses to its then-branch and the else-branch is dropped.
+			Name: "IfConstantCondition",
+			In: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							ifStmt(
+								binaryExpr(LessThanOp, floatExpr(1), floatExpr(2)),
+								block(nil, assignStmt(localVariableExpr(0), floatExpr(1))),
+								block(nil, assignStmt(localVariableExpr(0), floatExpr(2))),
+							),
+						),
+					},
+				},
+			},
+			Out: Program{
+				Funcs: []Func{
+					{
+						Index:     0,
+						OutParams: []Type{{Main: Float}},
+						Block: block(
+							nil,
+							blockStmt(block(nil, assignStmt(localVariableExpr(0), floatExpr(1)))),
+						),
+					},
+				},
+			},
+			Glsl: `void F0(out float l0) {
+	{
+		l0 = 1.000000000e+00;
+	}
+}`,
+		},
+	}
+
+	for _, tc := range tests {
+		in := tc.In
+		inBefore := cloneProgramForTest(in)
+
+		got := Optimize(in)
+		if !reflect.DeepEqual(got, tc.Out) {
+			t.Errorf("%s: got: %#v, want: %#v", tc.Name, got, tc.Out)
+			continue
+		}
+		if gotGlsl := got.Glsl(); gotGlsl != tc.Glsl+"\n" {
+			t.Errorf("%s: got: %s, want: %s", tc.Name, gotGlsl, tc.Glsl)
+		}
+		if !reflect.DeepEqual(in, inBefore) {
+			t.Errorf("%s: Optimize mutated its input: got: %#v, want: %#v", tc.Name, in, inBefore)
+		}
+	}
+}
+
+// cloneProgramForTest returns a deep copy of p via a JSON round trip,
+// so later comparisons can tell whether Optimize mutated its argument in
+// place instead of comparing a Program against itself.
+func cloneProgramForTest(p Program) Program {
+	var clone Program
+	data, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(data, &clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
@@ -0,0 +1,803 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// SPIR-V opcodes and enumerants used by this emitter. Only the subset
+// needed below is listed; see the SPIR-V specification for the rest.
+const (
+	opCapability          = 17
+	opExtInstImport       = 11
+	opExtInst             = 12
+	opMemoryModel         = 14
+	opEntryPoint          = 15
+	opExecutionMode       = 16
+	opTypeVoid            = 19
+	opTypeBool            = 20
+	opTypeInt             = 21
+	opTypeFloat           = 22
+	opTypeVector          = 23
+	opTypeMatrix          = 24
+	opTypeStruct          = 30
+	opTypePointer         = 32
+	opTypeFunction        = 33
+	opConstant            = 43
+	opFunction            = 54
+	opFunctionEnd         = 56
+	opVariable            = 59
+	opLoad                = 61
+	opStore               = 62
+	opAccessChain         = 65
+	opDecorate            = 71
+	opMemberDecorate      = 72
+	opVectorShuffle       = 79
+	opCompositeConstruct  = 80
+	opCompositeExtract    = 81
+	opFAdd                = 129
+	opFSub                = 131
+	opFMul                = 133
+	opFDiv                = 136
+	opFMod                = 141
+	opDot                 = 148
+	opSelect              = 169
+	opFOrdEqual           = 180
+	opFOrdNotEqual        = 182
+	opFOrdLessThan        = 184
+	opFOrdGreaterThan     = 186
+	opFOrdLessThanEqual   = 188
+	opFOrdGreaterThanEqual = 190
+	opLabel               = 248
+	opReturn              = 253
+)
+
+const (
+	addressingModelLogical = 0
+	memoryModelGLSL450     = 1
+)
+
+const (
+	executionModelVertex   = 0
+	executionModelFragment = 4
+)
+
+const (
+	storageClassInput    = 1
+	storageClassUniform  = 2
+	storageClassOutput   = 3
+	storageClassFunction = 7
+)
+
+const (
+	decorationBlock         = 2
+	decorationLocation      = 30
+	decorationBinding       = 33
+	decorationDescriptorSet = 34
+	decorationOffset        = 35
+	decorationBuiltIn       = 11
+)
+
+const (
+	builtInPosition  = 0
+	builtInFragCoord = 15
+)
+
+const executionModeOriginUpperLeft = 7
+
+// glslStd450 maps the BuiltinFuncs that have a direct GLSL.std.450 extended
+// instruction to that instruction's number. BuiltinFuncs absent from this
+// map either lower to a core SPIR-V opcode directly (Dot, Mod) or aren't
+// lowered yet.
+var glslStd450 = map[BuiltinFunc]uint32{
+	Abs:         4,
+	Floor:       8,
+	Ceil:        9,
+	Fract:       10,
+	Sin:         13,
+	Cos:         14,
+	Tan:         15,
+	Atan:        18,
+	Atan2:       25,
+	Pow:         26,
+	Exp:         27,
+	Log:         28,
+	Sqrt:        31,
+	InverseSqrt: 32,
+	Min:         37,
+	Max:         40,
+	Clamp:       43,
+	Mix:         46,
+	Step:        48,
+	Smoothstep:  49,
+	Length:      66,
+	Distance:    67,
+	Cross:       68,
+	Normalize:   69,
+}
+
+// spirvModule assembles a single SPIR-V binary module: capability and
+// memory-model declarations, debug-free type/constant/global-variable
+// declarations, and a single entry-point function.
+//
+// This is a hand-rolled id allocator and instruction encoder rather than a
+// wrapper around an external library (glslang et al.), so Ebiten's shader
+// pipeline never has to shell out to a GLSL-to-SPIR-V compiler at runtime.
+type spirvModule struct {
+	nextID uint32
+
+	capabilities []uint32
+	extInstGLSL  uint32
+	decorations  []uint32
+	typesGlobals []uint32
+	functions    []uint32
+
+	typeCache  map[string]uint32
+	ptrCache   map[string]uint32
+	constCache map[string]uint32
+	uintType   uint32
+}
+
+func newSpirvModule() *spirvModule {
+	return &spirvModule{
+		nextID:     1,
+		typeCache:  map[string]uint32{},
+		ptrCache:   map[string]uint32{},
+		constCache: map[string]uint32{},
+	}
+}
+
+func (m *spirvModule) id() uint32 {
+	id := m.nextID
+	m.nextID++
+	return id
+}
+
+func inst(section *[]uint32, opcode uint16, operands ...uint32) {
+	word0 := uint32(len(operands)+1)<<16 | uint32(opcode)
+	*section = append(*section, word0)
+	*section = append(*section, operands...)
+}
+
+// typeID returns the id of t's SPIR-V type, declaring it on first use.
+func (m *spirvModule) typeID(t Type) uint32 {
+	key := fmt.Sprintf("%d/%v", t.Main, t.Sub)
+	if id, ok := m.typeCache[key]; ok {
+		return id
+	}
+	var id uint32
+	switch t.Main {
+	case None:
+		id = m.id()
+		inst(&m.typesGlobals, opTypeVoid, id)
+	case Bool:
+		id = m.id()
+		inst(&m.typesGlobals, opTypeBool, id)
+	case Float:
+		id = m.id()
+		inst(&m.typesGlobals, opTypeFloat, id, 32)
+	case Vec2, Vec3, Vec4:
+		n := map[BasicType]uint32{Vec2: 2, Vec3: 3, Vec4: 4}[t.Main]
+		comp := m.typeID(Type{Main: Float})
+		id = m.id()
+		inst(&m.typesGlobals, opTypeVector, id, comp, n)
+	case Mat2, Mat3, Mat4:
+		n := map[BasicType]uint32{Mat2: 2, Mat3: 3, Mat4: 4}[t.Main]
+		col := map[BasicType]Type{Mat2: {Main: Vec2}, Mat3: {Main: Vec3}, Mat4: {Main: Vec4}}[t.Main]
+		colID := m.typeID(col)
+		id = m.id()
+		inst(&m.typesGlobals, opTypeMatrix, id, colID, n)
+	case Struct:
+		members := make([]uint32, len(t.Sub))
+		for i, f := range t.Sub {
+			members[i] = m.typeID(f)
+		}
+		id = m.id()
+		inst(&m.typesGlobals, opTypeStruct, append([]uint32{id}, members...)...)
+	default:
+		panic(fmt.Sprintf("shaderir: spirv: unsupported type: %d", t.Main))
+	}
+	m.typeCache[key] = id
+	return id
+}
+
+func (m *spirvModule) pointerType(storageClass uint32, t Type) uint32 {
+	base := m.typeID(t)
+	key := fmt.Sprintf("%d/%d", storageClass, base)
+	if id, ok := m.ptrCache[key]; ok {
+		return id
+	}
+	id := m.id()
+	inst(&m.typesGlobals, opTypePointer, id, storageClass, base)
+	m.ptrCache[key] = id
+	return id
+}
+
+// uintTypeID returns the id of a 32-bit unsigned int type, declaring it on
+// first use. SPIR-V indices into an OpAccessChain must be OpConstants of an
+// integer type, which this IR otherwise has no need for.
+func (m *spirvModule) uintTypeID() uint32 {
+	if m.uintType != 0 {
+		return m.uintType
+	}
+	id := m.id()
+	inst(&m.typesGlobals, opTypeInt, id, 32, 0)
+	m.uintType = id
+	return id
+}
+
+func (m *spirvModule) uintConstant(v uint32) uint32 {
+	key := fmt.Sprintf("u/%d", v)
+	if id, ok := m.constCache[key]; ok {
+		return id
+	}
+	id := m.id()
+	inst(&m.typesGlobals, opConstant, m.uintTypeID(), id, v)
+	m.constCache[key] = id
+	return id
+}
+
+func (m *spirvModule) floatConstant(v float32) uint32 {
+	key := fmt.Sprintf("f/%d", math.Float32bits(v))
+	if id, ok := m.constCache[key]; ok {
+		return id
+	}
+	id := m.id()
+	inst(&m.typesGlobals, opConstant, m.typeID(Type{Main: Float}), id, math.Float32bits(v))
+	m.constCache[key] = id
+	return id
+}
+
+// spirvIO describes one Input/Output/Function interface variable: its
+// storage class, its SPIR-V pointer type, and the id of the OpVariable
+// once declared.
+type spirvIO struct {
+	id           uint32
+	pointerType  uint32
+	storageClass uint32
+}
+
+// declareIO declares an Input or Output OpVariable for each type in ts at
+// consecutive Location decorations, returning one spirvIO per entry.
+func (m *spirvModule) declareIO(ts []Type, storageClass uint32) []spirvIO {
+	ios := make([]spirvIO, len(ts))
+	for i, t := range ts {
+		ptr := m.pointerType(storageClass, t)
+		id := m.id()
+		inst(&m.typesGlobals, opVariable, ptr, id, storageClass)
+		inst(&m.decorations, opDecorate, id, decorationLocation, uint32(i))
+		ios[i] = spirvIO{id: id, pointerType: ptr, storageClass: storageClass}
+	}
+	return ios
+}
+
+func (m *spirvModule) declareBuiltIn(t Type, storageClass, builtIn uint32) spirvIO {
+	ptr := m.pointerType(storageClass, t)
+	id := m.id()
+	inst(&m.typesGlobals, opVariable, ptr, id, storageClass)
+	inst(&m.decorations, opDecorate, id, decorationBuiltIn, builtIn)
+	return spirvIO{id: id, pointerType: ptr, storageClass: storageClass}
+}
+
+// std140Offsets returns the std140-style byte offset of each member of a
+// struct built from ts. This is a simplified approximation (8-byte
+// alignment for a vec2, 16-byte for everything larger) good enough for the
+// uniform blocks this IR currently produces; it does not yet handle
+// nested arrays or matrices precisely.
+func std140Offsets(ts []Type) []uint32 {
+	offsets := make([]uint32, len(ts))
+	var cur uint32
+	for i, t := range ts {
+		size, align := std140SizeAlign(t)
+		if cur%align != 0 {
+			cur += align - cur%align
+		}
+		offsets[i] = cur
+		cur += size
+	}
+	return offsets
+}
+
+func std140SizeAlign(t Type) (size, align uint32) {
+	switch t.Main {
+	case Float:
+		return 4, 4
+	case Vec2:
+		return 8, 8
+	case Vec3, Vec4:
+		return 16, 16
+	case Struct:
+		var total uint32
+		for _, f := range t.Sub {
+			s, a := std140SizeAlign(f)
+			if total%a != 0 {
+				total += a - total%a
+			}
+			total += s
+		}
+		return total, 16
+	default:
+		return 16, 16
+	}
+}
+
+// declareUniformBlock gathers p.Uniforms into a single struct decorated as
+// a uniform Block at descriptor set 0, binding 0, as Vulkan expects.
+func (m *spirvModule) declareUniformBlock(p *Program) *spirvIO {
+	if len(p.Uniforms) == 0 {
+		return nil
+	}
+	structType := Type{Main: Struct, Sub: p.Uniforms}
+	structID := m.typeID(structType)
+	inst(&m.decorations, opDecorate, structID, decorationBlock)
+	for i, off := range std140Offsets(p.Uniforms) {
+		inst(&m.decorations, opMemberDecorate, structID, uint32(i), decorationOffset, off)
+	}
+
+	ptr := m.pointerType(storageClassUniform, structType)
+	id := m.id()
+	inst(&m.typesGlobals, opVariable, ptr, id, storageClassUniform)
+	inst(&m.decorations, opDecorate, id, decorationDescriptorSet, 0)
+	inst(&m.decorations, opDecorate, id, decorationBinding, 0)
+	return &spirvIO{id: id, pointerType: ptr, storageClass: storageClassUniform}
+}
+
+// spirvExprCtx lowers Exprs into SPIR-V instructions within one entry
+// point's function body. It tracks the declared Type behind every
+// LocalVariable slot (attributes, varyings, the gl_Position/gl_FragCoord
+// slot, and Function-storage locals) alongside spirvModule's id-level
+// variable map, since SPIR-V instructions are typed and the IR's
+// LocalVariable indices alone don't carry that information.
+type spirvExprCtx struct {
+	m     *spirvModule
+	p     *Program
+	vars  map[int]spirvIO
+	types map[int]Type
+	ub    *spirvIO
+}
+
+func (c *spirvExprCtx) lower(e Expr) (id uint32, t Type, err error) {
+	switch e.Type {
+	case FloatExpr:
+		return c.m.floatConstant(e.Float), Type{Main: Float}, nil
+	case LocalVariable:
+		io, ok := c.vars[e.Index]
+		if !ok {
+			return 0, Type{}, fmt.Errorf("shaderir: spirv: local variable slot %d has no Function-storage variable support yet", e.Index)
+		}
+		vt := c.types[e.Index]
+		loaded := c.m.id()
+		inst(&c.m.functions, opLoad, c.m.typeID(vt), loaded, io.id)
+		return loaded, vt, nil
+	case UniformVariable:
+		if c.ub == nil || e.Index >= len(c.p.Uniforms) {
+			return 0, Type{}, fmt.Errorf("shaderir: spirv: uniform %d has no declared uniform block", e.Index)
+		}
+		ut := c.p.Uniforms[e.Index]
+		ptr := c.m.pointerType(storageClassUniform, ut)
+		chain := c.m.id()
+		inst(&c.m.functions, opAccessChain, ptr, chain, c.ub.id, c.m.uintConstant(uint32(e.Index)))
+		loaded := c.m.id()
+		inst(&c.m.functions, opLoad, c.m.typeID(ut), loaded, chain)
+		return loaded, ut, nil
+	case Binary:
+		return c.lowerBinary(e)
+	case Selection:
+		return c.lowerSelection(e)
+	case Call:
+		return c.lowerCall(e)
+	case FieldSelector:
+		return c.lowerFieldSelector(e)
+	case Index:
+		return c.lowerIndex(e)
+	default:
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: expression type %d is not supported in an entry point yet", e.Type)
+	}
+}
+
+var spirvArithOps = map[Op]uint16{
+	Add: opFAdd,
+	Sub: opFSub,
+	Mul: opFMul,
+	Div: opFDiv,
+}
+
+var spirvCompareOps = map[Op]uint16{
+	LessThanOp:         opFOrdLessThan,
+	LessThanEqualOp:    opFOrdLessThanEqual,
+	GreaterThanOp:      opFOrdGreaterThan,
+	GreaterThanEqualOp: opFOrdGreaterThanEqual,
+	EqualOp:            opFOrdEqual,
+	NotEqualOp:         opFOrdNotEqual,
+}
+
+func (c *spirvExprCtx) lowerBinary(e Expr) (uint32, Type, error) {
+	lid, lt, err := c.lower(e.Exprs[0])
+	if err != nil {
+		return 0, Type{}, err
+	}
+	rid, _, err := c.lower(e.Exprs[1])
+	if err != nil {
+		return 0, Type{}, err
+	}
+
+	if op, ok := spirvArithOps[e.Op]; ok {
+		id := c.m.id()
+		inst(&c.m.functions, op, c.m.typeID(lt), id, lid, rid)
+		return id, lt, nil
+	}
+	if e.Op == ModOp {
+		id := c.m.id()
+		inst(&c.m.functions, opFMod, c.m.typeID(lt), id, lid, rid)
+		return id, lt, nil
+	}
+	if op, ok := spirvCompareOps[e.Op]; ok {
+		id := c.m.id()
+		inst(&c.m.functions, op, c.m.typeID(Type{Main: Bool}), id, lid, rid)
+		return id, Type{Main: Bool}, nil
+	}
+	return 0, Type{}, fmt.Errorf("shaderir: spirv: binary operator %d is not supported in an entry point yet", e.Op)
+}
+
+func (c *spirvExprCtx) lowerSelection(e Expr) (uint32, Type, error) {
+	condID, condT, err := c.lower(e.Exprs[0])
+	if err != nil {
+		return 0, Type{}, err
+	}
+	if condT.Main != Bool {
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: a selection's condition must be boolean")
+	}
+	aID, t, err := c.lower(e.Exprs[1])
+	if err != nil {
+		return 0, Type{}, err
+	}
+	bID, _, err := c.lower(e.Exprs[2])
+	if err != nil {
+		return 0, Type{}, err
+	}
+	id := c.m.id()
+	inst(&c.m.functions, opSelect, c.m.typeID(t), id, condID, aID, bID)
+	return id, t, nil
+}
+
+var spirvVecConstructors = map[BuiltinFunc]BasicType{Vec2F: Vec2, Vec3F: Vec3, Vec4F: Vec4}
+var spirvMatConstructors = map[BuiltinFunc]BasicType{Mat2F: Mat2, Mat3F: Mat3, Mat4F: Mat4}
+
+func (c *spirvExprCtx) lowerCall(e Expr) (uint32, Type, error) {
+	callee := e.Exprs[0]
+	if callee.Type != BuiltinFuncExpr {
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: calling a user-defined function is not supported in an entry point yet")
+	}
+
+	args := e.Exprs[1:]
+	ids := make([]uint32, len(args))
+	var argType Type
+	for i, a := range args {
+		id, t, err := c.lower(a)
+		if err != nil {
+			return 0, Type{}, err
+		}
+		ids[i] = id
+		if i == 0 {
+			argType = t
+		}
+	}
+
+	if comp, ok := spirvVecConstructors[callee.BuiltinFunc]; ok {
+		t := Type{Main: comp}
+		id := c.m.id()
+		inst(&c.m.functions, opCompositeConstruct, append([]uint32{c.m.typeID(t), id}, ids...)...)
+		return id, t, nil
+	}
+	if comp, ok := spirvMatConstructors[callee.BuiltinFunc]; ok {
+		t := Type{Main: comp}
+		id := c.m.id()
+		inst(&c.m.functions, opCompositeConstruct, append([]uint32{c.m.typeID(t), id}, ids...)...)
+		return id, t, nil
+	}
+
+	switch callee.BuiltinFunc {
+	case Dot:
+		id := c.m.id()
+		inst(&c.m.functions, opDot, c.m.typeID(Type{Main: Float}), id, ids[0], ids[1])
+		return id, Type{Main: Float}, nil
+	case Length, Distance:
+		return c.extInst(glslStd450[callee.BuiltinFunc], Type{Main: Float}, ids)
+	case Mod:
+		// OpFMod's result takes the sign of its second operand: floored
+		// modulo, like the IR's Mod.
+		id := c.m.id()
+		inst(&c.m.functions, opFMod, c.m.typeID(argType), id, ids[0], ids[1])
+		return id, argType, nil
+	default:
+		if num, ok := glslStd450[callee.BuiltinFunc]; ok {
+			return c.extInst(num, argType, ids)
+		}
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: builtin %s is not supported in an entry point yet", glslBuiltinFuncs[callee.BuiltinFunc])
+	}
+}
+
+func (c *spirvExprCtx) extInst(num uint32, resultType Type, args []uint32) (uint32, Type, error) {
+	id := c.m.id()
+	operands := append([]uint32{c.m.typeID(resultType), id, c.m.extInstGLSL, num}, args...)
+	inst(&c.m.functions, opExtInst, operands...)
+	return id, resultType, nil
+}
+
+func (c *spirvExprCtx) lowerFieldSelector(e Expr) (uint32, Type, error) {
+	targetID, _, err := c.lower(e.Exprs[0])
+	if err != nil {
+		return 0, Type{}, err
+	}
+	sel := e.Exprs[1]
+	if sel.Type != SwizzlingExpr {
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: struct field selection is not supported in an entry point yet")
+	}
+
+	idxs := make([]uint32, len(sel.Swizzling))
+	for i := 0; i < len(sel.Swizzling); i++ {
+		j, ok := swizzleIndex(sel.Swizzling[i])
+		if !ok {
+			return 0, Type{}, fmt.Errorf("shaderir: spirv: swizzle %q is not supported", sel.Swizzling)
+		}
+		idxs[i] = uint32(j)
+	}
+
+	if len(idxs) == 1 {
+		id := c.m.id()
+		inst(&c.m.functions, opCompositeExtract, c.m.typeID(Type{Main: Float}), id, targetID, idxs[0])
+		return id, Type{Main: Float}, nil
+	}
+
+	comp := map[int]BasicType{2: Vec2, 3: Vec3, 4: Vec4}[len(idxs)]
+	t := Type{Main: comp}
+	id := c.m.id()
+	operands := append([]uint32{c.m.typeID(t), id, targetID, targetID}, idxs...)
+	inst(&c.m.functions, opVectorShuffle, operands...)
+	return id, t, nil
+}
+
+// constIntIndex evaluates e at lowering time if it is a compile-time
+// constant integer (an (IntF) cast of a FloatExpr, or a bare FloatExpr),
+// since OpCompositeExtract's index operand must be a literal, not an id.
+func constIntIndex(e Expr) (int, bool) {
+	if v, ok := floatLiteral(e); ok {
+		return int(v), true
+	}
+	if e.Type == Call && len(e.Exprs) == 2 && e.Exprs[0].Type == BuiltinFuncExpr && e.Exprs[0].BuiltinFunc == IntF {
+		return constIntIndex(e.Exprs[1])
+	}
+	return 0, false
+}
+
+func (c *spirvExprCtx) lowerIndex(e Expr) (uint32, Type, error) {
+	targetID, targetType, err := c.lower(e.Exprs[0])
+	if err != nil {
+		return 0, Type{}, err
+	}
+	lit, ok := constIntIndex(e.Exprs[1])
+	if !ok {
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: only a compile-time constant index is supported in an entry point yet")
+	}
+
+	var elem Type
+	switch targetType.Main {
+	case Mat2, Mat3, Mat4:
+		elem = Type{Main: map[BasicType]BasicType{Mat2: Vec2, Mat3: Vec3, Mat4: Vec4}[targetType.Main]}
+	case Vec2, Vec3, Vec4:
+		elem = Type{Main: Float}
+	default:
+		return 0, Type{}, fmt.Errorf("shaderir: spirv: indexing into type %d is not supported in an entry point yet", targetType.Main)
+	}
+
+	id := c.m.id()
+	inst(&c.m.functions, opCompositeExtract, c.m.typeID(elem), id, targetID, uint32(lit))
+	return id, elem, nil
+}
+
+// emitStage assembles the vertex or fragment entry point: the
+// attribute/varying/gl_Position(FragCoord) wiring, Function-storage locals
+// declared by block.LocalVars, and every Assign/ExprStmt in block's flat
+// statement list, lowered through spirvExprCtx. Control flow (If, For,
+// nested blocks) inside an entry point isn't lowered yet — that needs
+// basic blocks and branches, and is left for a follow-up.
+func (m *spirvModule) emitStage(p *Program, block Block, vertex bool) error {
+	// Only the vertex stage has attributes; in the fragment stage the
+	// varyings start at index 0, as in glslContext.localVarName.
+	var attrs []spirvIO
+	if vertex {
+		attrs = m.declareIO(p.Attributes, storageClassInput)
+	}
+	var varyings []spirvIO
+	if vertex {
+		varyings = m.declareIO(p.Varyings, storageClassOutput)
+	} else {
+		varyings = m.declareIO(p.Varyings, storageClassInput)
+	}
+
+	var special spirvIO
+	if vertex {
+		special = m.declareBuiltIn(Type{Main: Vec4}, storageClassOutput, builtInPosition)
+	} else {
+		special = m.declareBuiltIn(Type{Main: Vec4}, storageClassInput, builtInFragCoord)
+	}
+
+	ub := m.declareUniformBlock(p)
+
+	voidType := m.typeID(Type{Main: None})
+	fnType := m.id()
+	inst(&m.typesGlobals, opTypeFunction, fnType, voidType)
+
+	fnID := m.id()
+	inst(&m.functions, opFunction, voidType, fnID, 0, fnType)
+	labelID := m.id()
+	inst(&m.functions, opLabel, labelID)
+
+	reserved := len(attrs) + len(p.Varyings) + 1
+	vars := make(map[int]spirvIO, reserved+len(block.LocalVars))
+	types := make(map[int]Type, reserved+len(block.LocalVars))
+	for i, io := range attrs {
+		vars[i] = io
+		types[i] = p.Attributes[i]
+	}
+	for i, io := range varyings {
+		vars[len(attrs)+i] = io
+		types[len(attrs)+i] = p.Varyings[i]
+	}
+	vars[reserved-1] = special
+	types[reserved-1] = Type{Main: Vec4}
+
+	// Function-storage OpVariables must precede every other instruction in
+	// a function's first block, so these are declared right after OpLabel,
+	// before any statement is lowered.
+	for i, t := range block.LocalVars {
+		idx := reserved + i
+		ptr := m.pointerType(storageClassFunction, t)
+		id := m.id()
+		inst(&m.functions, opVariable, ptr, id, storageClassFunction)
+		vars[idx] = spirvIO{id: id, pointerType: ptr, storageClass: storageClassFunction}
+		types[idx] = t
+	}
+
+	ctx := &spirvExprCtx{m: m, p: p, vars: vars, types: types, ub: ub}
+
+	for _, stmt := range block.Stmts {
+		switch stmt.Type {
+		case Assign:
+			lhs, rhs := stmt.Exprs[0], stmt.Exprs[1]
+			if lhs.Type != LocalVariable {
+				return fmt.Errorf("shaderir: spirv: only a local-variable assignment target is supported in an entry point yet")
+			}
+			dst, ok := vars[lhs.Index]
+			if !ok {
+				return fmt.Errorf("shaderir: spirv: local variable slot %d has no Function-storage variable support yet", lhs.Index)
+			}
+			rid, _, err := ctx.lower(rhs)
+			if err != nil {
+				return err
+			}
+			inst(&m.functions, opStore, dst.id, rid)
+		case ExprStmt:
+			if _, _, err := ctx.lower(stmt.Exprs[0]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("shaderir: spirv: statement type %d is not supported in an entry point yet", stmt.Type)
+		}
+	}
+
+	inst(&m.functions, opReturn)
+	inst(&m.functions, opFunctionEnd)
+
+	model := uint32(executionModelFragment)
+	if vertex {
+		model = executionModelVertex
+	}
+	interfaceIDs := []uint32{}
+	for _, io := range attrs {
+		interfaceIDs = append(interfaceIDs, io.id)
+	}
+	for _, io := range varyings {
+		interfaceIDs = append(interfaceIDs, io.id)
+	}
+	interfaceIDs = append(interfaceIDs, special.id)
+
+	name := splitString("main")
+	ep := append([]uint32{model, fnID}, name...)
+	ep = append(ep, interfaceIDs...)
+	inst(&m.capabilities, opEntryPoint, ep...)
+
+	if !vertex {
+		inst(&m.capabilities, opExecutionMode, fnID, executionModeOriginUpperLeft)
+	}
+	return nil
+}
+
+func (m *spirvModule) bytes() []byte {
+	words := []uint32{0x07230203, 0x00010000, 0, m.nextID, 0}
+	words = append(words, m.capabilities...)
+	words = append(words, m.decorations...)
+	words = append(words, m.typesGlobals...)
+	words = append(words, m.functions...)
+
+	out := make([]byte, len(words)*4)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	return out
+}
+
+// SpirvModules holds the separate vertex and fragment SPIR-V binaries
+// compiled from a Program, ready to hand to a Vulkan pipeline without
+// shelling out to an external GLSL-to-SPIR-V compiler such as glslang.
+type SpirvModules struct {
+	Vertex   []byte
+	Fragment []byte
+}
+
+// Spirv compiles the program's vertex and fragment stages to SPIR-V.
+//
+// Entry-point bodies are lowered flat, statement by statement: arithmetic
+// (Binary), builtin calls (via GLSL.std.450 and a few core opcodes),
+// Selection, swizzles, matrix/vector constructors and constant-index
+// extraction are all supported, but control flow (If, For, nested blocks)
+// and calls into user-defined Funcs are not — those need real basic blocks
+// and are left for a follow-up.
+func (p *Program) Spirv() (SpirvModules, error) {
+	var out SpirvModules
+
+	if glslDefined(p.VertexFunc.Block) {
+		m := newSpirvModule()
+		inst(&m.capabilities, opCapability, 1) // Capability Shader
+		m.extInstGLSL = m.id()
+		inst(&m.capabilities, opExtInstImport, append([]uint32{m.extInstGLSL}, splitString("GLSL.std.450")...)...)
+		inst(&m.capabilities, opMemoryModel, addressingModelLogical, memoryModelGLSL450)
+		if err := m.emitStage(p, p.VertexFunc.Block, true); err != nil {
+			return out, err
+		}
+		out.Vertex = m.bytes()
+	}
+
+	if glslDefined(p.FragmentFunc.Block) {
+		m := newSpirvModule()
+		inst(&m.capabilities, opCapability, 1)
+		m.extInstGLSL = m.id()
+		inst(&m.capabilities, opExtInstImport, append([]uint32{m.extInstGLSL}, splitString("GLSL.std.450")...)...)
+		inst(&m.capabilities, opMemoryModel, addressingModelLogical, memoryModelGLSL450)
+		if err := m.emitStage(p, p.FragmentFunc.Block, false); err != nil {
+			return out, err
+		}
+		out.Fragment = m.bytes()
+	}
+
+	return out, nil
+}
+
+// splitString packs s into the null-terminated, 4-byte-padded word
+// sequence SPIR-V literal strings use.
+func splitString(s string) []uint32 {
+	b := append([]byte(s), 0)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	words := make([]uint32, len(b)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(b[i*4 : i*4+4])
+	}
+	return words
+}
@@ -0,0 +1,422 @@
+// Copyright 2020 The Ebiten Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shaderir_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/hajimehoshi/ebiten/internal/shaderir"
+)
+
+// disassemble turns a SPIR-V binary module back into a line-oriented
+// mnemonic listing, so tests can assert on readable text instead of raw
+// words. It only decodes the opcode subset Program.Spirv emits; anything
+// else is printed as "OpUnknown<N> ...".
+func disassemble(module []byte) (string, error) {
+	if len(module)%4 != 0 {
+		return "", fmt.Errorf("disassemble: length %d is not a multiple of 4", len(module))
+	}
+	words := make([]uint32, len(module)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(module[i*4 : i*4+4])
+	}
+	if len(words) < 5 || words[0] != 0x07230203 {
+		return "", fmt.Errorf("disassemble: missing SPIR-V magic number")
+	}
+
+	names := map[uint16]string{
+		17:  "OpCapability",
+		11:  "OpExtInstImport",
+		12:  "OpExtInst",
+		14:  "OpMemoryModel",
+		15:  "OpEntryPoint",
+		16:  "OpExecutionMode",
+		19:  "OpTypeVoid",
+		20:  "OpTypeBool",
+		21:  "OpTypeInt",
+		22:  "OpTypeFloat",
+		23:  "OpTypeVector",
+		24:  "OpTypeMatrix",
+		30:  "OpTypeStruct",
+		32:  "OpTypePointer",
+		33:  "OpTypeFunction",
+		43:  "OpConstant",
+		54:  "OpFunction",
+		56:  "OpFunctionEnd",
+		59:  "OpVariable",
+		61:  "OpLoad",
+		62:  "OpStore",
+		65:  "OpAccessChain",
+		71:  "OpDecorate",
+		72:  "OpMemberDecorate",
+		79:  "OpVectorShuffle",
+		80:  "OpCompositeConstruct",
+		81:  "OpCompositeExtract",
+		129: "OpFAdd",
+		131: "OpFSub",
+		133: "OpFMul",
+		136: "OpFDiv",
+		141: "OpFMod",
+		148: "OpDot",
+		169: "OpSelect",
+		180: "OpFOrdEqual",
+		182: "OpFOrdNotEqual",
+		184: "OpFOrdLessThan",
+		186: "OpFOrdGreaterThan",
+		188: "OpFOrdLessThanEqual",
+		190: "OpFOrdGreaterThanEqual",
+		248: "OpLabel",
+		253: "OpReturn",
+	}
+	// Opcodes whose operand stream ends in a null-terminated literal
+	// string rather than plain words.
+	stringOps := map[uint16]int{
+		11: 1, // OpExtInstImport: %result <literal name>
+		15: 2, // OpEntryPoint: model %entry <literal name> interface...
+	}
+
+	var lines []string
+	i := 5
+	for i < len(words) {
+		word0 := words[i]
+		wordCount := int(word0 >> 16)
+		opcode := uint16(word0 & 0xffff)
+		if wordCount == 0 || i+wordCount > len(words) {
+			return "", fmt.Errorf("disassemble: malformed instruction at word %d", i)
+		}
+		operands := words[i+1 : i+wordCount]
+
+		name, ok := names[opcode]
+		if !ok {
+			name = fmt.Sprintf("OpUnknown%d", opcode)
+		}
+
+		var fields []string
+		if stringFrom, ok := stringOps[opcode]; ok {
+			for _, w := range operands[:stringFrom] {
+				fields = append(fields, fmt.Sprint(w))
+			}
+			str, rest := decodeString(operands[stringFrom:])
+			fields = append(fields, fmt.Sprintf("%q", str))
+			for _, w := range rest {
+				fields = append(fields, fmt.Sprint(w))
+			}
+		} else {
+			for _, w := range operands {
+				fields = append(fields, fmt.Sprint(w))
+			}
+		}
+
+		line := name
+		if len(fields) > 0 {
+			line += " " + strings.Join(fields, " ")
+		}
+		lines = append(lines, line)
+
+		i += wordCount
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// decodeString reads a null-terminated, word-packed literal string off the
+// front of words, returning the string and the remaining words.
+func decodeString(words []uint32) (string, []uint32) {
+	var b []byte
+	for i, w := range words {
+		var wb [4]byte
+		binary.LittleEndian.PutUint32(wb[:], w)
+		for _, c := range wb {
+			if c == 0 {
+				return string(b), words[i+1:]
+			}
+			b = append(b, c)
+		}
+	}
+	return string(b), nil
+}
+
+func TestOutputSpirv(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Program  Program
+		Vertex   string
+		Fragment string
+	}{
+		{
+			Name:     "Empty",
+			Program:  Program{},
+			Vertex:   "",
+			Fragment: "",
+		},
+		{
+			// A single attribute forwarded straight to gl_Position: the
+			// smallest program that exercises declareIO, declareBuiltIn
+			// and the Assign lowering in emitStage.
+			Name: "VertexOnly",
+			Program: Program{
+				Attributes: []Type{
+					{Main: Vec4},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(1),
+							localVariableExpr(0),
+						),
+					),
+				},
+			},
+			Vertex: strings.Join([]string{
+				"OpCapability 1",
+				`OpExtInstImport 1 "GLSL.std.450"`,
+				"OpMemoryModel 0 1",
+				`OpEntryPoint 0 10 "main" 5 7`,
+				"OpDecorate 5 30 0",
+				"OpDecorate 7 11 0",
+				"OpTypeFloat 2 32",
+				"OpTypeVector 3 2 4",
+				"OpTypePointer 4 1 3",
+				"OpVariable 4 5 1",
+				"OpTypePointer 6 3 3",
+				"OpVariable 6 7 3",
+				"OpTypeVoid 8",
+				"OpTypeFunction 9 8",
+				"OpFunction 8 10 0 9",
+				"OpLabel 11",
+				"OpLoad 3 12 5",
+				"OpStore 7 12",
+				"OpReturn",
+				"OpFunctionEnd",
+			}, "\n"),
+			Fragment: "",
+		},
+		{
+			// Binary Add between two vec4 attributes lowers to a plain
+			// OpFAdd on the loaded operands.
+			Name: "VertexBinaryAdd",
+			Program: Program{
+				Attributes: []Type{
+					{Main: Vec4},
+					{Main: Vec4},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(2),
+							binaryExpr(Add, localVariableExpr(0), localVariableExpr(1)),
+						),
+					),
+				},
+			},
+			Vertex: strings.Join([]string{
+				"OpCapability 1",
+				`OpExtInstImport 1 "GLSL.std.450"`,
+				"OpMemoryModel 0 1",
+				`OpEntryPoint 0 11 "main" 5 6 8`,
+				"OpDecorate 5 30 0",
+				"OpDecorate 6 30 1",
+				"OpDecorate 8 11 0",
+				"OpTypeFloat 2 32",
+				"OpTypeVector 3 2 4",
+				"OpTypePointer 4 1 3",
+				"OpVariable 4 5 1",
+				"OpVariable 4 6 1",
+				"OpTypePointer 7 3 3",
+				"OpVariable 7 8 3",
+				"OpTypeVoid 9",
+				"OpTypeFunction 10 9",
+				"OpFunction 9 11 0 10",
+				"OpLabel 12",
+				"OpLoad 3 13 5",
+				"OpLoad 3 14 6",
+				"OpFAdd 3 15 13 14",
+				"OpStore 8 15",
+				"OpReturn",
+				"OpFunctionEnd",
+			}, "\n"),
+			Fragment: "",
+		},
+		{
+			// mix(A0, A1, U0) exercises a GLSL.std.450 builtin call whose
+			// last argument is read out of the uniform block via
+			// OpAccessChain+OpLoad.
+			Name: "VertexUniformMix",
+			Program: Program{
+				Attributes: []Type{
+					{Main: Vec4},
+					{Main: Vec4},
+				},
+				Uniforms: []Type{
+					{Main: Float},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(2),
+							callExpr(builtinFuncExpr(Mix), localVariableExpr(0), localVariableExpr(1), uniformVariableExpr(0)),
+						),
+					),
+				},
+			},
+			Vertex: strings.Join([]string{
+				"OpCapability 1",
+				`OpExtInstImport 1 "GLSL.std.450"`,
+				"OpMemoryModel 0 1",
+				`OpEntryPoint 0 14 "main" 5 6 8`,
+				"OpDecorate 5 30 0",
+				"OpDecorate 6 30 1",
+				"OpDecorate 8 11 0",
+				"OpDecorate 9 2",
+				"OpMemberDecorate 9 0 35 0",
+				"OpDecorate 11 34 0",
+				"OpDecorate 11 33 0",
+				"OpTypeFloat 2 32",
+				"OpTypeVector 3 2 4",
+				"OpTypePointer 4 1 3",
+				"OpVariable 4 5 1",
+				"OpVariable 4 6 1",
+				"OpTypePointer 7 3 3",
+				"OpVariable 7 8 3",
+				"OpTypeStruct 9 2",
+				"OpTypePointer 10 2 9",
+				"OpVariable 10 11 2",
+				"OpTypeVoid 12",
+				"OpTypeFunction 13 12",
+				"OpTypePointer 18 2 2",
+				"OpTypeInt 21 32 0",
+				"OpConstant 21 20 0",
+				"OpFunction 12 14 0 13",
+				"OpLabel 15",
+				"OpLoad 3 16 5",
+				"OpLoad 3 17 6",
+				"OpAccessChain 18 19 11 20",
+				"OpLoad 2 22 19",
+				"OpExtInst 3 23 1 46 16 17 22",
+				"OpStore 8 23",
+				"OpReturn",
+				"OpFunctionEnd",
+			}, "\n"),
+			Fragment: "",
+		},
+		{
+			// (U0 < 1.0) ? A0 : A1 exercises a comparison (OpFOrdLessThan)
+			// feeding a Selection (OpSelect).
+			Name: "VertexSelection",
+			Program: Program{
+				Attributes: []Type{
+					{Main: Vec4},
+					{Main: Vec4},
+				},
+				Uniforms: []Type{
+					{Main: Float},
+				},
+				VertexFunc: VertexFunc{
+					Block: block(
+						nil,
+						assignStmt(
+							localVariableExpr(2),
+							selectionExpr(
+								binaryExpr(LessThanOp, uniformVariableExpr(0), floatExpr(1)),
+								localVariableExpr(0),
+								localVariableExpr(1),
+							),
+						),
+					),
+				},
+			},
+			Vertex: strings.Join([]string{
+				"OpCapability 1",
+				`OpExtInstImport 1 "GLSL.std.450"`,
+				"OpMemoryModel 0 1",
+				`OpEntryPoint 0 14 "main" 5 6 8`,
+				"OpDecorate 5 30 0",
+				"OpDecorate 6 30 1",
+				"OpDecorate 8 11 0",
+				"OpDecorate 9 2",
+				"OpMemberDecorate 9 0 35 0",
+				"OpDecorate 11 34 0",
+				"OpDecorate 11 33 0",
+				"OpTypeFloat 2 32",
+				"OpTypeVector 3 2 4",
+				"OpTypePointer 4 1 3",
+				"OpVariable 4 5 1",
+				"OpVariable 4 6 1",
+				"OpTypePointer 7 3 3",
+				"OpVariable 7 8 3",
+				"OpTypeStruct 9 2",
+				"OpTypePointer 10 2 9",
+				"OpVariable 10 11 2",
+				"OpTypeVoid 12",
+				"OpTypeFunction 13 12",
+				"OpTypePointer 16 2 2",
+				"OpTypeInt 19 32 0",
+				"OpConstant 19 18 0",
+				"OpConstant 2 21 1065353216",
+				"OpTypeBool 23",
+				"OpFunction 12 14 0 13",
+				"OpLabel 15",
+				"OpAccessChain 16 17 11 18",
+				"OpLoad 2 20 17",
+				"OpFOrdLessThan 23 22 20 21",
+				"OpLoad 3 24 5",
+				"OpLoad 3 25 6",
+				"OpSelect 3 26 22 24 25",
+				"OpStore 8 26",
+				"OpReturn",
+				"OpFunctionEnd",
+			}, "\n"),
+			Fragment: "",
+		},
+	}
+	for _, tc := range tests {
+		modules, err := tc.Program.Spirv()
+		if err != nil {
+			t.Errorf("%s: Spirv returned an error: %v", tc.Name, err)
+			continue
+		}
+
+		gotVertex := ""
+		if len(modules.Vertex) > 0 {
+			var err error
+			gotVertex, err = disassemble(modules.Vertex)
+			if err != nil {
+				t.Errorf("%s: disassemble(Vertex): %v", tc.Name, err)
+				continue
+			}
+		}
+		if gotVertex != tc.Vertex {
+			t.Errorf("%s: vertex: got:\n%s\nwant:\n%s", tc.Name, gotVertex, tc.Vertex)
+		}
+
+		gotFragment := ""
+		if len(modules.Fragment) > 0 {
+			var err error
+			gotFragment, err = disassemble(modules.Fragment)
+			if err != nil {
+				t.Errorf("%s: disassemble(Fragment): %v", tc.Name, err)
+				continue
+			}
+		}
+		if gotFragment != tc.Fragment {
+			t.Errorf("%s: fragment: got:\n%s\nwant:\n%s", tc.Name, gotFragment, tc.Fragment)
+		}
+	}
+}